@@ -0,0 +1,333 @@
+package sftpd
+
+import (
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/OpenListTeam/sftpd-openlist/binp"
+)
+
+// parseAttr parses the ATTRS of the negotiated protocol version into a.
+func parseAttr(p *binp.Parser, a *Attr, version uint32) *binp.Parser {
+	if version < 4 {
+		return parseAttrV3(p, a)
+	}
+	var flags uint32
+	var typ byte
+	p = p.B32(&flags).B8(&typ)
+	subsec := flags&ssh_FILEXFER_ATTR_SUBSECOND_TIMES != 0
+	if flags&ssh_FILEXFER_ATTR_SIZE != 0 {
+		p = p.B64(&a.Size)
+		a.Flags |= ATTR_SIZE
+	}
+	if version >= 6 && flags&ssh_FILEXFER_ATTR_ALLOCATION_SIZE != 0 {
+		var n uint64
+		p = p.B64(&n)
+	}
+	if flags&ssh_FILEXFER_ATTR_OWNERGROUP != 0 {
+		p = p.B32String(&a.User).B32String(&a.Group)
+		a.Flags |= ATTR_OWNERGROUP
+		// Numeric owners are passed as Uid and Gid too.
+		uid, ue := strconv.ParseUint(a.User, 10, 32)
+		gid, ge := strconv.ParseUint(a.Group, 10, 32)
+		if ue == nil && ge == nil {
+			a.Uid, a.Gid = uint32(uid), uint32(gid)
+			a.Flags |= ATTR_UIDGID
+		}
+	}
+	if flags&ssh_FILEXFER_ATTR_PERMISSIONS != 0 {
+		var mode uint32
+		p = p.B32(&mode)
+		a.Mode = sftpToFileMode(mode)
+		a.Flags |= ATTR_MODE
+	}
+	if t := typeToFileMode(typ); t != 0 {
+		a.Mode = a.Mode&^os.ModeType | t
+	}
+	if flags&ssh_FILEXFER_ATTR_ACCESSTIME != 0 {
+		p = inTime(p, &a.ATime, subsec)
+		a.Flags |= ATTR_ATIME
+	}
+	if flags&ssh_FILEXFER_ATTR_CREATETIME != 0 {
+		p = inTime(p, &a.CreateTime, subsec)
+		a.Flags |= ATTR_CREATETIME
+	}
+	if flags&ssh_FILEXFER_ATTR_MODIFYTIME != 0 {
+		p = inTime(p, &a.MTime, subsec)
+		a.Flags |= ATTR_MTIME
+	}
+	if a.Flags&(ATTR_ATIME|ATTR_MTIME) == ATTR_ATIME|ATTR_MTIME {
+		a.Flags = a.Flags&^(ATTR_ATIME|ATTR_MTIME) | ATTR_TIME
+	}
+	if version >= 6 && flags&ssh_FILEXFER_ATTR_CTIME != 0 {
+		p = inTime(p, &a.CTime, subsec)
+		a.Flags |= ATTR_CTIME
+	}
+	if flags&ssh_FILEXFER_ATTR_ACL != 0 {
+		p = p.B32Bytes(&a.ACL)
+		a.Flags |= ATTR_ACL
+	}
+	if version >= 5 && flags&ssh_FILEXFER_ATTR_BITS != 0 {
+		p = p.B32(&a.AttribBits)
+		if version >= 6 {
+			p = p.B32(&a.AttribBitsValid)
+		}
+		a.Flags |= ATTR_BITS
+	}
+	if version >= 6 {
+		// Not passed to the FileSystem.
+		var hint byte
+		var s string
+		var n uint32
+		if flags&ssh_FILEXFER_ATTR_TEXT_HINT != 0 {
+			p = p.B8(&hint)
+		}
+		if flags&ssh_FILEXFER_ATTR_MIME_TYPE != 0 {
+			p = p.B32String(&s)
+		}
+		if flags&ssh_FILEXFER_ATTR_LINK_COUNT != 0 {
+			p = p.B32(&n)
+		}
+		if flags&ssh_FILEXFER_ATTR_UNTRANSLATED_NAME != 0 {
+			p = p.B32String(&s)
+		}
+	}
+	if flags&ssh_FILEXFER_ATTR_EXTENDED != 0 {
+		p = parseExtended(p, a)
+		a.Flags |= ssh_FILEXFER_ATTR_EXTENDED
+	}
+	return p
+}
+
+func parseAttrV3(p *binp.Parser, a *Attr) *binp.Parser {
+	p = p.B32(&a.Flags)
+	if a.Flags&ssh_FILEXFER_ATTR_SIZE != 0 {
+		p = p.B64(&a.Size)
+	}
+	if a.Flags&ssh_FILEXFER_ATTR_UIDGID != 0 {
+		p = p.B32(&a.Uid).B32(&a.Gid)
+	}
+	if a.Flags&ssh_FILEXFER_ATTR_PERMISSIONS != 0 {
+		var mode uint32
+		p = p.B32(&mode)
+		a.Mode = sftpToFileMode(mode)
+	}
+	if a.Flags&ssh_FILEXFER_ATTR_ACMODTIME != 0 {
+		p = inTimes(p, a)
+	}
+	if a.Flags&ssh_FILEXFER_ATTR_EXTENDED != 0 {
+		p = parseExtended(p, a)
+	}
+	return p
+}
+
+func parseExtended(p *binp.Parser, a *Attr) *binp.Parser {
+	var count uint32
+	p = p.B32(&count)
+	if count > 0xFF {
+		return nil
+	}
+	ss := make([]string, 2*int(count))
+	for i := 0; i < int(count); i++ {
+		var k, v string
+		p = p.B32String(&k).B32String(&v)
+		ss[2*i+0] = k
+		ss[2*i+1] = v
+	}
+	a.Extended = ss
+	return p
+}
+
+func writeAttr(c io.Writer, version, id uint32, a *Attr, e error, debugf DebugLogger) error {
+	if e != nil {
+		return writeErr(c, version, id, e, debugf)
+	}
+	var l binp.Len
+	o := binp.Out().LenB32(&l).LenStart(&l).Byte(ssh_FXP_ATTRS).B32(id)
+	outAttr(o, a, version)
+	o.LenDone(&l)
+	return wrc(c, o.Out())
+}
+
+// outAttr prints a as the ATTRS of the negotiated protocol version.
+func outAttr(o *binp.Printer, a *Attr, version uint32) {
+	if version < 4 {
+		outAttrV3(o, a)
+		return
+	}
+	var flags uint32
+	hasATime := a.Flags&(ATTR_TIME|ATTR_ATIME) != 0
+	hasMTime := a.Flags&(ATTR_TIME|ATTR_MTIME) != 0
+	hasCTime := version >= 6 && a.Flags&ATTR_CTIME != 0
+	user, group := a.User, a.Group
+	switch {
+	case a.Flags&ATTR_OWNERGROUP != 0:
+		flags |= ssh_FILEXFER_ATTR_OWNERGROUP
+	case a.Flags&ATTR_UIDGID != 0:
+		user, group = strconv.FormatUint(uint64(a.Uid), 10), strconv.FormatUint(uint64(a.Gid), 10)
+		flags |= ssh_FILEXFER_ATTR_OWNERGROUP
+	}
+	if hasATime {
+		flags |= ssh_FILEXFER_ATTR_ACCESSTIME
+	}
+	if hasMTime {
+		flags |= ssh_FILEXFER_ATTR_MODIFYTIME
+	}
+	if hasCTime {
+		flags |= ssh_FILEXFER_ATTR_CTIME
+	}
+	flags |= a.Flags & (ATTR_SIZE | ATTR_MODE | ATTR_CREATETIME | ATTR_ACL | ssh_FILEXFER_ATTR_EXTENDED)
+	if version >= 5 {
+		flags |= a.Flags & ATTR_BITS
+	}
+	if flags&(ssh_FILEXFER_ATTR_ACCESSTIME|ssh_FILEXFER_ATTR_CREATETIME|ssh_FILEXFER_ATTR_MODIFYTIME|ssh_FILEXFER_ATTR_CTIME) != 0 {
+		flags |= ssh_FILEXFER_ATTR_SUBSECOND_TIMES
+	}
+	o.B32(flags).B8(attrType(a, version))
+	if flags&ssh_FILEXFER_ATTR_SIZE != 0 {
+		o.B64(a.Size)
+	}
+	if flags&ssh_FILEXFER_ATTR_OWNERGROUP != 0 {
+		o.B32String(user).B32String(group)
+	}
+	if flags&ssh_FILEXFER_ATTR_PERMISSIONS != 0 {
+		o.B32(fileModeToSftp(a.Mode))
+	}
+	if hasATime {
+		outTime(o, a.ATime)
+	}
+	if flags&ssh_FILEXFER_ATTR_CREATETIME != 0 {
+		outTime(o, a.CreateTime)
+	}
+	if hasMTime {
+		outTime(o, a.MTime)
+	}
+	if hasCTime {
+		outTime(o, a.CTime)
+	}
+	if flags&ssh_FILEXFER_ATTR_ACL != 0 {
+		o.B32Bytes(a.ACL)
+	}
+	if flags&ssh_FILEXFER_ATTR_BITS != 0 {
+		o.B32(a.AttribBits)
+		if version >= 6 {
+			o.B32(a.AttribBitsValid)
+		}
+	}
+	if flags&ssh_FILEXFER_ATTR_EXTENDED != 0 {
+		outExtended(o, a)
+	}
+}
+
+func outAttrV3(o *binp.Printer, a *Attr) {
+	flags := a.Flags & (ATTR_SIZE | ATTR_UIDGID | ATTR_MODE | ATTR_TIME | ssh_FILEXFER_ATTR_EXTENDED)
+	o.B32(flags)
+	if flags&ssh_FILEXFER_ATTR_SIZE != 0 {
+		o.B64(a.Size)
+	}
+	if flags&ssh_FILEXFER_ATTR_UIDGID != 0 {
+		o.B32(a.Uid).B32(a.Gid)
+	}
+	if flags&ssh_FILEXFER_ATTR_PERMISSIONS != 0 {
+		o.B32(fileModeToSftp(a.Mode))
+	}
+	if flags&ssh_FILEXFER_ATTR_ACMODTIME != 0 {
+		outTimes(o, a)
+	}
+	if flags&ssh_FILEXFER_ATTR_EXTENDED != 0 {
+		outExtended(o, a)
+	}
+}
+
+func outExtended(o *binp.Printer, a *Attr) {
+	count := uint32(len(a.Extended) / 2)
+	o.B32(count)
+	for _, s := range a.Extended[:2*count] {
+		o.B32String(s)
+	}
+}
+
+// outName prints an entry of a SSH_FXP_NAME packet, the long name is only sent in SFTP version 3.
+func outName(o *binp.Printer, name, longname string, a *Attr, version uint32) {
+	o.B32String(name)
+	if version < 4 {
+		o.B32String(longname)
+	}
+	outAttr(o, a, version)
+}
+
+// attrType returns the file type byte of SFTP version 4 and later.
+func attrType(a *Attr, version uint32) byte {
+	if a.Flags&ATTR_MODE == 0 {
+		return ssh_FILEXFER_TYPE_UNKNOWN
+	}
+	m := a.Mode
+	switch {
+	case m.IsRegular():
+		return ssh_FILEXFER_TYPE_REGULAR
+	case m.IsDir():
+		return ssh_FILEXFER_TYPE_DIRECTORY
+	case m&os.ModeSymlink != 0:
+		return ssh_FILEXFER_TYPE_SYMLINK
+	case m&os.ModeIrregular != 0:
+		return ssh_FILEXFER_TYPE_UNKNOWN
+	case version < 5:
+		return ssh_FILEXFER_TYPE_SPECIAL
+	case m&os.ModeSocket != 0:
+		return ssh_FILEXFER_TYPE_SOCKET
+	case m&os.ModeCharDevice != 0:
+		return ssh_FILEXFER_TYPE_CHAR_DEVICE
+	case m&os.ModeDevice != 0:
+		return ssh_FILEXFER_TYPE_BLOCK_DEVICE
+	case m&os.ModeNamedPipe != 0:
+		return ssh_FILEXFER_TYPE_FIFO
+	}
+	return ssh_FILEXFER_TYPE_SPECIAL
+}
+
+// typeToFileMode returns the os.FileMode type bits of a file type byte.
+func typeToFileMode(typ byte) os.FileMode {
+	switch typ {
+	case ssh_FILEXFER_TYPE_DIRECTORY:
+		return os.ModeDir
+	case ssh_FILEXFER_TYPE_SYMLINK:
+		return os.ModeSymlink
+	case ssh_FILEXFER_TYPE_SOCKET:
+		return os.ModeSocket
+	case ssh_FILEXFER_TYPE_CHAR_DEVICE:
+		return os.ModeDevice | os.ModeCharDevice
+	case ssh_FILEXFER_TYPE_BLOCK_DEVICE:
+		return os.ModeDevice
+	case ssh_FILEXFER_TYPE_FIFO:
+		return os.ModeNamedPipe
+	}
+	return 0
+}
+
+func outTimes(o *binp.Printer, a *Attr) {
+	o.B32(uint32(a.ATime.Unix())).B32(uint32(a.MTime.Unix()))
+}
+func inTimes(p *binp.Parser, a *Attr) *binp.Parser {
+	var at, mt uint32
+	p = p.B32(&at).B32(&mt)
+	a.ATime = time.Unix(int64(at), 0)
+	a.MTime = time.Unix(int64(mt), 0)
+	return p
+}
+
+// outTime prints a 64 bit time with nanoseconds of SFTP version 4 and later.
+func outTime(o *binp.Printer, t time.Time) {
+	o.B64(uint64(t.Unix())).B32(uint32(t.Nanosecond()))
+}
+func inTime(p *binp.Parser, t *time.Time, subsec bool) *binp.Parser {
+	var sec uint64
+	var nsec uint32
+	p = p.B64(&sec)
+	if subsec {
+		p = p.B32(&nsec)
+	}
+	*t = time.Unix(int64(sec), int64(nsec))
+	return p
+}
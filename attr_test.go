@@ -0,0 +1,115 @@
+package sftpd
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/OpenListTeam/sftpd-openlist/binp"
+)
+
+// roundTripAttr encodes a in version and decodes it again.
+func roundTripAttr(t *testing.T, a *Attr, version uint32) *Attr {
+	o := binp.Out()
+	outAttr(o, a, version)
+	var r Attr
+	if e := parseAttr(binp.NewParser(o.Out()), &r, version).End(); e != nil {
+		t.Fatalf("v%d: parseAttr: %v", version, e)
+	}
+	return &r
+}
+
+func TestAttrRoundTrip(t *testing.T) {
+	full := Attr{
+		Flags: ATTR_SIZE | ATTR_OWNERGROUP | ATTR_MODE | ATTR_TIME | ATTR_CREATETIME | ATTR_CTIME |
+			ATTR_ACL | ATTR_BITS | ssh_FILEXFER_ATTR_EXTENDED,
+		Size:            1<<40 + 5,
+		User:            "alice",
+		Group:           "staff",
+		Mode:            0640,
+		ATime:           time.Unix(1700000000, 123456789),
+		MTime:           time.Unix(1700000100, 987654321),
+		CreateTime:      time.Unix(1600000000, 5),
+		CTime:           time.Unix(1700000200, 42),
+		ACL:             []byte{0, 0, 0, 0},
+		AttribBits:      0x4,
+		AttribBitsValid: 0x4,
+		Extended:        []string{"name@example.com", "value"},
+	}
+	v3 := Attr{
+		Flags:    ATTR_SIZE | ATTR_MODE | ATTR_TIME | ssh_FILEXFER_ATTR_EXTENDED,
+		Size:     full.Size,
+		Mode:     full.Mode,
+		ATime:    time.Unix(full.ATime.Unix(), 0),
+		MTime:    time.Unix(full.MTime.Unix(), 0),
+		Extended: full.Extended,
+	}
+	v4 := full
+	v4.Flags &^= ATTR_CTIME | ATTR_BITS
+	v4.CTime, v4.AttribBits, v4.AttribBitsValid = time.Time{}, 0, 0
+	v5 := full
+	v5.Flags &^= ATTR_CTIME
+	v5.CTime, v5.AttribBitsValid = time.Time{}, 0
+	for version, want := range map[uint32]*Attr{3: &v3, 4: &v4, 5: &v5, 6: &full} {
+		if got := roundTripAttr(t, &full, version); !reflect.DeepEqual(got, want) {
+			t.Errorf("v%d:\n got %+v\nwant %+v", version, got, want)
+		}
+	}
+}
+
+func TestAttrRoundTripOwnerAndTimes(t *testing.T) {
+	for _, version := range []uint32{4, 5, 6} {
+		got := roundTripAttr(t, &Attr{Flags: ATTR_UIDGID, Uid: 1000, Gid: 100}, version)
+		want := &Attr{Flags: ATTR_UIDGID | ATTR_OWNERGROUP, Uid: 1000, Gid: 100, User: "1000", Group: "100"}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("v%d numeric owner: got %+v, want %+v", version, got, want)
+		}
+		mtime := time.Unix(1700000000, 1)
+		got = roundTripAttr(t, &Attr{Flags: ATTR_MTIME, MTime: mtime}, version)
+		if got.Flags != ATTR_MTIME || !got.MTime.Equal(mtime) {
+			t.Errorf("v%d modify time alone: got %+v", version, got)
+		}
+	}
+}
+
+func TestVersionNegotiation(t *testing.T) {
+	tests := []struct {
+		client, max, want uint32
+	}{
+		{2, 0, 3},
+		{3, 0, 3},
+		{4, 0, 4},
+		{5, 0, 5},
+		{6, 0, 6},
+		{7, 0, 6},
+		{6, 4, 4},
+		{5, 1, 3},
+	}
+	for _, tt := range tests {
+		c := newTestClient(t, newMemFS(nil), &ServeOptions{MaxVersion: tt.max}, tt.client)
+		if c.version != tt.want {
+			t.Errorf("client %d, MaxVersion %d: negotiated %d, want %d", tt.client, tt.max, c.version, tt.want)
+		}
+		c.close()
+	}
+}
+
+func TestStatAttrVersions(t *testing.T) {
+	for _, version := range []uint32{3, 4, 5, 6} {
+		c := newTestClient(t, newMemFS(map[string]string{"/f": "12345"}), nil, version)
+		o := binp.Out().B32(1).B32String("/f")
+		if version >= 4 {
+			o.B32(ATTR_SIZE | ATTR_MODE)
+		}
+		c.send(ssh_FXP_STAT, o)
+		op, data := c.recv()
+		var id uint32
+		var a Attr
+		if op != ssh_FXP_ATTRS || parseAttr(binp.NewParser(data).B32(&id), &a, version).End() != nil {
+			t.Errorf("v%d: STAT answered with packet type %d %x", version, op, data)
+		} else if a.Flags&(ATTR_SIZE|ATTR_MODE) != ATTR_SIZE|ATTR_MODE || a.Size != 5 || a.Mode != 0644 {
+			t.Errorf("v%d: STAT got %+v", version, a)
+		}
+		c.close()
+	}
+}
@@ -78,6 +78,9 @@ func (p *Parser) Align(n int) *Parser {
 
 // Skip bytes.
 func (p *Parser) Skip(n int) *Parser {
+	if p == nil {
+		return nil
+	}
 	p.off += n
 	return p
 }
@@ -100,12 +103,13 @@ func (p *Parser) String0(d *string) *Parser {
 // Check that we are at the end of input.
 func (p *Parser) End() error {
 	if p == nil || p.off != len(p.r) {
-		return eparse
+		return ErrInvalidInput
 	}
 	return nil
 }
 
-var eparse = errors.New("binparser invalid input")
+// ErrInvalidInput is returned by End if the input did not parse or was not consumed completely.
+var ErrInvalidInput = errors.New("binparser invalid input")
 
 // Check that we are at the end of input.
 func (p *Parser) AtEnd() bool {
@@ -114,6 +118,9 @@ func (p *Parser) AtEnd() bool {
 
 // Peek the rest of input as raw bytes.
 func (p *Parser) PeekRest(d *[]byte) *Parser {
+	if p == nil {
+		return nil
+	}
 	*d = p.r[p.off:]
 	return p
 }
@@ -0,0 +1,150 @@
+package sftpd
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+
+	"github.com/OpenListTeam/sftpd-openlist/binp"
+)
+
+func init() {
+	builtinExtension("copy-file", "1", copyFileExt, nil).paths = firstTwoPaths
+	builtinExtension("copy-data", "1", copyData, nil).lane = copyDataLane
+}
+
+// copyBufferSize is the chunk size used when the server copies data itself.
+const copyBufferSize = 64 * 1024
+
+var errCopyOverlap = &StatusError{Code: STATUS_FAILURE, Message: "Copy source and destination overlap"}
+
+// errCopyAccess is returned by copy-data for a source handle not opened for
+// reading or a destination handle not opened for writing.
+var errCopyAccess = &StatusError{Code: STATUS_PERMISSION_DENIED}
+
+func copyFileExt(r *ExtendedRequest) ([]byte, error) {
+	var src, dst string
+	var overwrite byte
+	e := binp.NewParser(r.Data).B32String(&src).B32String(&dst).Byte(&overwrite).End()
+	if e != nil {
+		return nil, e
+	}
+	return nil, copyFile(r.FileSystem, r.Path(src), r.Path(dst), overwrite != 0)
+}
+
+// copyFile copies src to dst natively if possible and by streaming the data otherwise.
+func copyFile(fs FileSystem, src, dst string, overwrite bool) error {
+	if cfs, ok := fs.(FileSystemExtensionCopy); ok {
+		e := cfs.CopyFile(src, dst, overwrite)
+		if !errors.Is(e, errors.ErrUnsupported) {
+			return e
+		}
+	}
+	if path.Clean(src) == path.Clean(dst) {
+		return errCopyOverlap
+	}
+	flags := uint32(ssh_FXF_WRITE | ssh_FXF_CREAT | ssh_FXF_TRUNC)
+	if !overwrite {
+		if _, e := fs.Stat(dst, false); e == nil {
+			return &os.PathError{Op: "copy", Path: dst, Err: os.ErrExist}
+		}
+		flags |= ssh_FXF_EXCL
+	}
+	rd, e := openTransfer(fs, src, ssh_FXF_READ, &Attr{}, 0)
+	if e != nil {
+		return e
+	}
+	defer func() { _ = rd.Close() }()
+	wr, e := openTransfer(fs, dst, flags, &Attr{}, 0)
+	if e != nil {
+		return e
+	}
+	_, e = io.Copy(wr, rd)
+	if e != nil {
+		// A partial copy must not replace dst.
+		_ = abort(wr)
+		return e
+	}
+	return wr.Close()
+}
+
+// copyData implements copy-data, copying a range of the file behind one handle
+// into the file behind another. A read length of zero copies up to the end of file.
+func copyData(r *ExtendedRequest) ([]byte, error) {
+	var srcHandle, dstHandle string
+	var srcOffset, length, dstOffset uint64
+	e := binp.NewParser(r.Data).B32String(&srcHandle).B64(&srcOffset).B64(&length).B32String(&dstHandle).B64(&dstOffset).End()
+	if e != nil {
+		return nil, e
+	}
+	src, dst := r.h.getFile(srcHandle), r.h.getFile(dstHandle)
+	if src == nil || dst == nil {
+		return nil, errInvalidHandle
+	}
+	if OpenFlags(src.flags)&OPEN_READ == 0 || OpenFlags(dst.flags)&OPEN_WRITE == 0 {
+		return nil, errCopyAccess
+	}
+	if srcHandle == dstHandle && (length == 0 || (srcOffset < dstOffset+length && dstOffset < srcOffset+length)) {
+		return nil, errCopyOverlap
+	}
+	// A whole file copied into a handle that has not been written yet can be done
+	// natively. The writer opened eagerly is aborted first, closing it would
+	// commit an empty file over the copy.
+	if cfs, ok := r.FileSystem.(FileSystemExtensionCopy); ok && srcOffset == 0 && length == 0 && dstOffset == 0 && !r.h.hasWritten(dstHandle) {
+		e = r.h.dropWriter(dstHandle)
+		if e != nil {
+			return nil, e
+		}
+		e = cfs.CopyFile(src.name, dst.name, true)
+		if !errors.Is(e, errors.ErrUnsupported) {
+			r.h.keepContent(dstHandle)
+			return nil, e
+		}
+	}
+	rd, e := openTransfer(r.FileSystem, src.name, ssh_FXF_READ, &Attr{}, srcOffset)
+	if e != nil {
+		return nil, e
+	}
+	defer func() { _ = rd.Close() }()
+	wr, e := r.h.writer(r.FileSystem, dstHandle, dstOffset)
+	if e != nil {
+		return nil, e
+	}
+	var in io.Reader = rd
+	if length != 0 {
+		in = io.LimitReader(rd, int64(length))
+	}
+	e = copyAt(wr, in, int64(dstOffset))
+	r.h.markWritten(dstHandle)
+	return nil, e
+}
+
+// copyDataLane orders copy-data with the requests on the destination handle.
+func copyDataLane(data []byte) string {
+	var src, dst string
+	var srcOffset, length uint64
+	binp.NewParser(data).B32String(&src).B64(&srcOffset).B64(&length).B32String(&dst)
+	return dst
+}
+
+// copyAt copies rd to w starting at off until EOF.
+func copyAt(w io.WriterAt, rd io.Reader, off int64) error {
+	buf := make([]byte, copyBufferSize)
+	for {
+		n, e := rd.Read(buf)
+		if n > 0 {
+			_, we := w.WriteAt(buf[:n], off)
+			if we != nil {
+				return we
+			}
+			off += int64(n)
+		}
+		if e == io.EOF {
+			return nil
+		}
+		if e != nil {
+			return e
+		}
+	}
+}
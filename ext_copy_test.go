@@ -0,0 +1,35 @@
+package sftpd
+
+import (
+	"testing"
+
+	"github.com/OpenListTeam/sftpd-openlist/binp"
+)
+
+func TestCopyDataAccess(t *testing.T) {
+	fs := newMemFS(map[string]string{"/src": "source data", "/ro": "read only"})
+	c := newTestClient(t, fs, nil, 3)
+	defer c.close()
+	src := c.open(1, "/src", ssh_FXF_READ)
+	ro := c.open(2, "/ro", ssh_FXF_READ)
+	wo := c.open(3, "/wo", ssh_FXF_WRITE|ssh_FXF_CREAT)
+	copyData := func(id uint32, from, to string) uint32 {
+		c.send(ssh_FXP_EXTENDED, binp.Out().B32(id).B32String("copy-data").B32String(from).B64(0).B64(0).B32String(to).B64(0))
+		return c.status()
+	}
+	if code := copyData(4, src, ro); code != ssh_FX_PERMISSION_DENIED {
+		t.Errorf("copy into a read only handle: status %d, want %d", code, ssh_FX_PERMISSION_DENIED)
+	}
+	if got := fs.content("/ro"); got != "read only" {
+		t.Errorf("read only destination changed to %q", got)
+	}
+	if code := copyData(5, wo, ro); code != ssh_FX_PERMISSION_DENIED {
+		t.Errorf("copy from a write only handle: status %d, want %d", code, ssh_FX_PERMISSION_DENIED)
+	}
+	if code := copyData(6, src, wo); code != ssh_FX_OK {
+		t.Errorf("copy into a write handle: status %d, want %d", code, ssh_FX_OK)
+	}
+	if got := fs.content("/wo"); got != "source data" {
+		t.Errorf("destination is %q, want %q", got, "source data")
+	}
+}
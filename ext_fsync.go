@@ -0,0 +1,32 @@
+package sftpd
+
+import (
+	"errors"
+
+	"github.com/OpenListTeam/sftpd-openlist/binp"
+)
+
+func init() {
+	builtinExtension("fsync@openssh.com", "1", fsync, nil).lane = firstHandle
+}
+
+// fsync implements fsync@openssh.com on the writer of an open file handle.
+// A handle without a writer has nothing to commit and succeeds.
+func fsync(r *ExtendedRequest) ([]byte, error) {
+	var handle string
+	e := binp.NewParser(r.Data).B32String(&handle).End()
+	if e != nil {
+		return nil, e
+	}
+	if r.h.getFile(handle) == nil {
+		return nil, errInvalidHandle
+	}
+	w, ok := r.h.getWriter(handle)
+	if !ok {
+		return nil, nil
+	}
+	if s, ok := w.(FileTransferExtensionSync); ok {
+		return nil, s.Sync()
+	}
+	return nil, errors.ErrUnsupported
+}
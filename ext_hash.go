@@ -0,0 +1,282 @@
+package sftpd
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+	"strings"
+
+	"github.com/OpenListTeam/sftpd-openlist/binp"
+)
+
+func init() {
+	builtinExtension("check-file-name", "1", checkFileName, nil).paths = firstPath
+	builtinExtension("check-file-handle", "1", checkFileHandle, nil).lane = firstHandle
+	builtinExtension("md5-hash", "1", md5Hash, nil).paths = firstPath
+	builtinExtension("md5-hash-handle", "1", md5HashHandle, nil).lane = firstHandle
+	builtinExtension("sha256-hash", "1", sha256Hash, nil).paths = firstPath
+	builtinExtension("sha256-hash-handle", "1", sha256HashHandle, nil).lane = firstHandle
+}
+
+// hashAlgorithms are the check-file algorithms the server can compute itself.
+var hashAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha224": sha256.New224,
+	"sha256": sha256.New,
+	"sha384": sha512.New384,
+	"sha512": sha512.New,
+	"crc32":  func() hash.Hash { return crc32.NewIEEE() },
+}
+
+// minCheckFileBlockSize is the smallest non-zero block size allowed by check-file.
+const minCheckFileBlockSize = 256
+
+// quickCheckLength is the length of the prefix covered by the quick-check-hash
+// of md5-hash and sha256-hash.
+const quickCheckLength = 2048
+
+// checkFileReplyRoom is the room left for the header and algorithm name of a
+// check-file reply when capping its hashes to the packet length.
+const checkFileReplyRoom = 1024
+
+var errInvalidBlockSize = &StatusError{Code: STATUS_FAILURE, Message: "Invalid check-file block size"}
+
+var errCheckFileTooLong = &StatusError{Code: STATUS_FAILURE, Message: "check-file reply exceeds the maximum packet length"}
+
+func checkFileName(r *ExtendedRequest) ([]byte, error) {
+	var name, algs string
+	var offset, length uint64
+	var blockSize uint32
+	e := binp.NewParser(r.Data).B32String(&name).B32String(&algs).B64(&offset).B64(&length).B32(&blockSize).End()
+	if e != nil {
+		return nil, e
+	}
+	return checkFile(r.FileSystem, r.Path(name), algs, offset, length, blockSize, r.opts.MaxPacketLength)
+}
+
+func checkFileHandle(r *ExtendedRequest) ([]byte, error) {
+	var handle, algs string
+	var offset, length uint64
+	var blockSize uint32
+	e := binp.NewParser(r.Data).B32String(&handle).B32String(&algs).B64(&offset).B64(&length).B32(&blockSize).End()
+	if e != nil {
+		return nil, e
+	}
+	f := r.h.getFile(handle)
+	if f == nil {
+		return nil, errInvalidHandle
+	}
+	return checkFile(r.FileSystem, f.name, algs, offset, length, blockSize, r.opts.MaxPacketLength)
+}
+
+// checkFile answers check-file-name and check-file-handle with the first algorithm of
+// the comma separated list that the FileSystem has a stored hash for, or failing that
+// the first one the server can compute. Requests for more block hashes than fit in a
+// packet of maxPacket bytes are rejected.
+func checkFile(fs FileSystem, name, algs string, offset, length uint64, blockSize, maxPacket uint32) ([]byte, error) {
+	if blockSize != 0 && blockSize < minCheckFileBlockSize {
+		return nil, errInvalidBlockSize
+	}
+	var known []string
+	for _, alg := range strings.Split(algs, ",") {
+		if hashAlgorithms[alg] != nil {
+			known = append(known, alg)
+		}
+	}
+	if len(known) == 0 {
+		return nil, errors.ErrUnsupported
+	}
+	maxBlocks := func(alg string) uint64 {
+		return uint64(maxPacket-checkFileReplyRoom) / uint64(hashAlgorithms[alg]().Size())
+	}
+	for _, alg := range known {
+		sums, e := storedHash(fs, name, alg, offset, length, uint64(blockSize), maxBlocks(alg))
+		if !errors.Is(e, errors.ErrUnsupported) {
+			return checkFileReply(alg, sums, e)
+		}
+	}
+	sums, e := streamHash(fs, name, known[0], offset, length, uint64(blockSize), maxBlocks(known[0]))
+	return checkFileReply(known[0], sums, e)
+}
+
+func checkFileReply(alg string, sums []byte, e error) ([]byte, error) {
+	if e != nil {
+		return nil, e
+	}
+	return binp.Out().B32String("check-file").B32String(alg).Bytes(sums).Out(), nil
+}
+
+func md5Hash(r *ExtendedRequest) ([]byte, error) {
+	return digestName(r, "md5")
+}
+
+func md5HashHandle(r *ExtendedRequest) ([]byte, error) {
+	return digestHandle(r, "md5")
+}
+
+func sha256Hash(r *ExtendedRequest) ([]byte, error) {
+	return digestName(r, "sha256")
+}
+
+func sha256HashHandle(r *ExtendedRequest) ([]byte, error) {
+	return digestHandle(r, "sha256")
+}
+
+// digestName answers md5-hash and sha256-hash with the digest alg of a path.
+func digestName(r *ExtendedRequest, alg string) ([]byte, error) {
+	var name, quick string
+	var offset, length uint64
+	e := binp.NewParser(r.Data).B32String(&name).B64(&offset).B64(&length).B32String(&quick).End()
+	if e != nil {
+		return nil, e
+	}
+	return digestSum(r.FileSystem, r.Path(name), alg, offset, length, quick)
+}
+
+// digestHandle answers md5-hash-handle and sha256-hash-handle with the digest alg of a handle.
+func digestHandle(r *ExtendedRequest, alg string) ([]byte, error) {
+	var handle, quick string
+	var offset, length uint64
+	e := binp.NewParser(r.Data).B32String(&handle).B64(&offset).B64(&length).B32String(&quick).End()
+	if e != nil {
+		return nil, e
+	}
+	f := r.h.getFile(handle)
+	if f == nil {
+		return nil, errInvalidHandle
+	}
+	return digestSum(r.FileSystem, f.name, alg, offset, length, quick)
+}
+
+// digestSum returns the reply of md5-hash or sha256-hash, named alg+"-hash". If the
+// client sends the digest of the first bytes as quick-check-hash and it does not
+// match, an empty digest is returned.
+func digestSum(fs FileSystem, name, alg string, offset, length uint64, quick string) ([]byte, error) {
+	if quick != "" {
+		n := uint64(quickCheckLength)
+		if length != 0 && length < n {
+			n = length
+		}
+		sum, e := hashRange(fs, name, alg, offset, n, 0)
+		if e != nil {
+			return nil, e
+		}
+		if string(sum) != quick {
+			return binp.Out().B32String(alg + "-hash").B32String("").Out(), nil
+		}
+	}
+	sum, e := hashRange(fs, name, alg, offset, length, 0)
+	if e != nil {
+		return nil, e
+	}
+	return binp.Out().B32String(alg + "-hash").B32Bytes(sum).Out(), nil
+}
+
+// hashRange returns the digest of the range.
+func hashRange(fs FileSystem, name, alg string, offset, length, blockSize uint64) ([]byte, error) {
+	sums, e := storedHash(fs, name, alg, offset, length, blockSize, 1)
+	if errors.Is(e, errors.ErrUnsupported) {
+		return streamHash(fs, name, alg, offset, length, blockSize, 1)
+	}
+	return sums, e
+}
+
+// storedHash asks a FileSystemExtensionHash for the digests of the blocks of the
+// range concatenated, or a single digest if blockSize is zero. It fails with
+// errCheckFileTooLong if there are more than maxBlocks blocks.
+func storedHash(fs FileSystem, name, alg string, offset, length, blockSize, maxBlocks uint64) ([]byte, error) {
+	hfs, ok := fs.(FileSystemExtensionHash)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+	if blockSize == 0 {
+		return hfs.Hash(name, alg, offset, length)
+	}
+	if length == 0 {
+		a, e := fs.Stat(name, false)
+		if e != nil {
+			return nil, e
+		}
+		if a.Flags&ATTR_SIZE == 0 {
+			return nil, errors.ErrUnsupported
+		}
+		if a.Size > offset {
+			length = a.Size - offset
+		}
+	}
+	if blockCount(length, blockSize) > maxBlocks {
+		return nil, errCheckFileTooLong
+	}
+	var sums []byte
+	for length > 0 {
+		n := min(blockSize, length)
+		sum, e := hfs.Hash(name, alg, offset, n)
+		if e != nil {
+			return nil, e
+		}
+		sums = append(sums, sum...)
+		offset += n
+		length -= n
+	}
+	return sums, nil
+}
+
+// streamHash computes the digests like storedHash by reading the file.
+func streamHash(fs FileSystem, name, alg string, offset, length, blockSize, maxBlocks uint64) ([]byte, error) {
+	if blockSize != 0 && blockCount(length, blockSize) > maxBlocks {
+		return nil, errCheckFileTooLong
+	}
+	t, e := openTransfer(fs, name, ssh_FXF_READ, &Attr{}, offset)
+	if e != nil {
+		return nil, e
+	}
+	defer func() { _ = t.Close() }()
+	var rd io.Reader = t
+	if length != 0 {
+		rd = io.LimitReader(t, int64(length))
+	}
+	newHash := hashAlgorithms[alg]
+	if blockSize == 0 {
+		h := newHash()
+		_, e = io.Copy(h, rd)
+		if e != nil {
+			return nil, e
+		}
+		return h.Sum(nil), nil
+	}
+	var sums []byte
+	for blocks := uint64(0); ; blocks++ {
+		if blocks == maxBlocks {
+			if n, _ := io.ReadFull(rd, make([]byte, 1)); n > 0 {
+				return nil, errCheckFileTooLong
+			}
+			return sums, nil
+		}
+		h := newHash()
+		n, e := io.CopyN(h, rd, int64(blockSize))
+		if n > 0 {
+			sums = h.Sum(sums)
+		}
+		if e == io.EOF {
+			return sums, nil
+		}
+		if e != nil {
+			return nil, e
+		}
+	}
+}
+
+// blockCount is the number of blocks of blockSize bytes covering length bytes.
+func blockCount(length, blockSize uint64) uint64 {
+	n := length / blockSize
+	if length%blockSize != 0 {
+		n++
+	}
+	return n
+}
@@ -0,0 +1,51 @@
+package sftpd
+
+import (
+	"crypto/sha512"
+	"strings"
+	"testing"
+
+	"github.com/OpenListTeam/sftpd-openlist/binp"
+)
+
+// hashFS is a memFS with stored hashes counting the calls to Hash.
+type hashFS struct {
+	*memFS
+	calls int
+}
+
+func (fs *hashFS) Hash(name, algorithm string, offset, length uint64) ([]byte, error) {
+	fs.calls++
+	return make([]byte, sha512.Size), nil
+}
+
+func TestCheckFileReplyLimit(t *testing.T) {
+	data := strings.Repeat("0123456789abcdef", 200000/16)
+	const maxPacket = minPacketLength
+	maxBlocks := (maxPacket - checkFileReplyRoom) / sha512.Size
+	for _, fs := range []FileSystem{newMemFS(map[string]string{"/f": data}), &hashFS{memFS: newMemFS(map[string]string{"/f": data})}} {
+		_, e := checkFile(fs, "/f", "sha512", 0, 0, 256, maxPacket)
+		if e != errCheckFileTooLong {
+			t.Errorf("%T whole file: got %v, want %v", fs, e, errCheckFileTooLong)
+		}
+		if hfs, ok := fs.(*hashFS); ok && hfs.calls != 0 {
+			t.Errorf("Hash called %d times for a rejected request", hfs.calls)
+		}
+		_, e = checkFile(fs, "/f", "sha512", 0, 1<<64-1, 256, maxPacket)
+		if e != errCheckFileTooLong {
+			t.Errorf("%T huge length: got %v, want %v", fs, e, errCheckFileTooLong)
+		}
+		reply, e := checkFile(fs, "/f", "sha512", 0, uint64(maxBlocks*256), 256, maxPacket)
+		if e != nil {
+			t.Fatalf("%T %d blocks: %v", fs, maxBlocks, e)
+		}
+		var ext, alg string
+		var sums []byte
+		if binp.NewParser(reply).B32String(&ext).B32String(&alg).PeekRest(&sums) == nil || len(sums) != maxBlocks*sha512.Size {
+			t.Errorf("%T %d blocks: got %d bytes of hashes", fs, maxBlocks, len(sums))
+		}
+		if len(reply) > maxPacket {
+			t.Errorf("%T reply of %d bytes exceeds the packet length", fs, len(reply))
+		}
+	}
+}
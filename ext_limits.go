@@ -0,0 +1,20 @@
+package sftpd
+
+import "github.com/OpenListTeam/sftpd-openlist/binp"
+
+func init() {
+	builtinExtension("limits@openssh.com", "1", limits, nil)
+}
+
+// limits implements limits@openssh.com reporting the limits of ServeOptions.
+func limits(r *ExtendedRequest) ([]byte, error) {
+	e := binp.NewParser(r.Data).End()
+	if e != nil {
+		return nil, e
+	}
+	return binp.OutCap(4 * 8).
+		B64(uint64(r.opts.MaxPacketLength)).
+		B64(uint64(r.opts.MaxReadLength)).
+		B64(uint64(r.opts.MaxWriteLength)).
+		B64(uint64(r.opts.MaxOpenHandles)).Out(), nil
+}
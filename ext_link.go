@@ -0,0 +1,17 @@
+package sftpd
+
+import "github.com/OpenListTeam/sftpd-openlist/binp"
+
+func init() {
+	builtinExtension("hardlink@openssh.com", "1", hardLink, nil).paths = firstTwoPaths
+}
+
+// hardLink implements hardlink@openssh.com, the arguments are the existing path followed by the new link.
+func hardLink(r *ExtendedRequest) ([]byte, error) {
+	var oldPath, newPath string
+	e := binp.NewParser(r.Data).B32String(&oldPath).B32String(&newPath).End()
+	if e != nil {
+		return nil, e
+	}
+	return nil, r.FileSystem.CreateLink(r.Path(newPath), r.Path(oldPath), LINK_HARD)
+}
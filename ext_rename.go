@@ -0,0 +1,17 @@
+package sftpd
+
+import "github.com/OpenListTeam/sftpd-openlist/binp"
+
+func init() {
+	builtinExtension("posix-rename@openssh.com", "1", posixRename, nil).paths = firstTwoPaths
+}
+
+// posixRename implements posix-rename@openssh.com which replaces an existing target.
+func posixRename(r *ExtendedRequest) ([]byte, error) {
+	var oldName, newName string
+	e := binp.NewParser(r.Data).B32String(&oldName).B32String(&newName).End()
+	if e != nil {
+		return nil, e
+	}
+	return nil, r.FileSystem.Rename(r.Path(oldName), r.Path(newName), RENAME_OVERWRITE)
+}
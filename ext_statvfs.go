@@ -0,0 +1,47 @@
+package sftpd
+
+import "github.com/OpenListTeam/sftpd-openlist/binp"
+
+func init() {
+	builtinExtension("statvfs@openssh.com", "2", statVFS, supportsStatVFS)
+	builtinExtension("fstatvfs@openssh.com", "2", fstatVFS, supportsStatVFS).lane = firstHandle
+}
+
+func supportsStatVFS(fs FileSystem) bool {
+	_, ok := fs.(FileSystemExtensionStatVFS)
+	return ok
+}
+
+func statVFS(r *ExtendedRequest) ([]byte, error) {
+	var path string
+	e := binp.NewParser(r.Data).B32String(&path).End()
+	if e != nil {
+		return nil, e
+	}
+	return statVFSReply(r.FileSystem, r.Path(path))
+}
+
+func fstatVFS(r *ExtendedRequest) ([]byte, error) {
+	var handle string
+	e := binp.NewParser(r.Data).B32String(&handle).End()
+	if e != nil {
+		return nil, e
+	}
+	path, ok := r.h.getName(handle)
+	if !ok {
+		return nil, errInvalidHandle
+	}
+	return statVFSReply(r.FileSystem, path)
+}
+
+func statVFSReply(fs FileSystem, path string) ([]byte, error) {
+	st, e := fs.(FileSystemExtensionStatVFS).StatVFS(path)
+	if e != nil {
+		return nil, e
+	}
+	return binp.OutCap(11 * 8).
+		B64(st.BlockSize).B64(st.FragmentSize).
+		B64(st.Blocks).B64(st.BlocksFree).B64(st.BlocksAvail).
+		B64(st.Files).B64(st.FilesFree).B64(st.FilesAvail).
+		B64(st.FSID).B64(st.Flags).B64(st.NameMax).Out(), nil
+}
@@ -0,0 +1,155 @@
+package sftpd
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/OpenListTeam/sftpd-openlist/binp"
+)
+
+// ExtendedRequest is a SSH_FXP_EXTENDED request passed to an ExtensionHandler.
+type ExtendedRequest struct {
+	// Name is the extension name, e.g. "name@vendor".
+	Name string
+	// Data is the request specific data following the name. It is only
+	// valid for the duration of the handler call.
+	Data []byte
+	// FileSystem is the FileSystem the channel is served with.
+	FileSystem FileSystem
+
+	h       *handles
+	opts    *ServeOptions
+	home    homeDir
+	version uint32
+	// replyType is the packet type of a non-nil reply, SSH_FXP_EXTENDED_REPLY if zero.
+	replyType byte
+}
+
+// Path resolves a path sent by the client like the server does for the standard requests,
+// i.e. relative paths are taken relative to the home directory of the user.
+func (r *ExtendedRequest) Path(p string) string {
+	return r.home.abs(p)
+}
+
+// ExtensionHandler serves a SSH_FXP_EXTENDED request.
+// Handlers are called concurrently for the requests of a session.
+// A non-nil reply is sent back as the data of a SSH_FXP_EXTENDED_REPLY packet,
+// a nil reply with a nil error is answered with a SSH_FX_OK status and errors
+// are mapped to a status like for every other request.
+type ExtensionHandler func(r *ExtendedRequest) (reply []byte, err error)
+
+type extension struct {
+	name    string
+	data    string
+	handler ExtensionHandler
+	// supported reports whether the extension works with a FileSystem,
+	// nil means always.
+	supported func(FileSystem) bool
+	// lane returns the handle the request data refers to, if any, so the
+	// request is ordered with the other requests on that handle.
+	lane func(data []byte) string
+	// paths returns the paths the request data refers to, so the request is
+	// ordered with the other requests on those paths and their handles.
+	paths func(data []byte) []string
+}
+
+// Extensions is a registry of SSH_FXP_EXTENDED handlers.
+// Registered extensions are advertised in the SSH_FXP_VERSION packet.
+type Extensions struct {
+	mu sync.RWMutex
+	m  map[string]*extension
+}
+
+// DefaultExtensions is the registry used by ServeChannel unless ServeOptions.Extensions is set.
+var DefaultExtensions = &Extensions{}
+
+// Register adds a handler for the extension name, e.g. "name@vendor".
+// data is advertised together with the name, typically a version like "1".
+// Registering a name again replaces the previous handler, including the
+// ones built into this package. Unlike the built-in extensions, registered
+// handlers are not ordered with the other requests on the handles or paths
+// in their data and cannot access the open handles of the session.
+func (x *Extensions) Register(name, data string, handler ExtensionHandler) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.m == nil {
+		x.m = map[string]*extension{}
+	}
+	x.m[name] = &extension{name: name, data: data, handler: handler}
+}
+
+// Unregister removes the handler for the extension name.
+func (x *Extensions) Unregister(name string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	delete(x.m, name)
+}
+
+// RegisterExtension adds a handler to DefaultExtensions.
+func RegisterExtension(name, data string, handler ExtensionHandler) {
+	DefaultExtensions.Register(name, data, handler)
+}
+
+func (x *Extensions) lookup(name string) *extension {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	if ext, ok := x.m[name]; ok {
+		return ext
+	}
+	return builtinExtensions[name]
+}
+
+// advertised returns the extensions usable with fs sorted by name.
+func (x *Extensions) advertised(fs FileSystem) []*extension {
+	x.mu.RLock()
+	seen := map[string]bool{}
+	var exts []*extension
+	for name, ext := range x.m {
+		seen[name] = true
+		exts = append(exts, ext)
+	}
+	x.mu.RUnlock()
+	for name, ext := range builtinExtensions {
+		if !seen[name] {
+			exts = append(exts, ext)
+		}
+	}
+	var res []*extension
+	for _, ext := range exts {
+		if ext.supported == nil || ext.supported(fs) {
+			res = append(res, ext)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].name < res[j].name })
+	return res
+}
+
+// builtinExtensions are the extensions implemented by this package.
+var builtinExtensions = map[string]*extension{}
+
+func builtinExtension(name, data string, handler ExtensionHandler, supported func(FileSystem) bool) *extension {
+	ext := &extension{name: name, data: data, handler: handler, supported: supported}
+	builtinExtensions[name] = ext
+	return ext
+}
+
+// firstHandle is the lane of extensions whose data starts with a handle.
+func firstHandle(data []byte) string {
+	var k string
+	binp.NewParser(data).B32String(&k)
+	return k
+}
+
+// firstPath is the paths of extensions whose data starts with a path.
+func firstPath(data []byte) []string {
+	var p string
+	binp.NewParser(data).B32String(&p)
+	return []string{p}
+}
+
+// firstTwoPaths is the paths of extensions whose data starts with two paths.
+func firstTwoPaths(data []byte) []string {
+	var p1, p2 string
+	binp.NewParser(data).B32String(&p1).B32String(&p2)
+	return []string{p1, p2}
+}
@@ -0,0 +1,24 @@
+package sftpd
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestServeOptionsExtensions(t *testing.T) {
+	exts := &Extensions{}
+	exts.Register("test@example.com", "1", func(r *ExtendedRequest) ([]byte, error) { return nil, nil })
+	opts := (&ServeOptions{Extensions: exts}).withDefaults()
+	if opts.Extensions.lookup("test@example.com") == nil {
+		t.Fatal("registered extension not found")
+	}
+	if !bytes.Contains(versionReply(3, EmptyFS{}, opts.Extensions), []byte("test@example.com")) {
+		t.Error("registered extension not advertised")
+	}
+	if DefaultExtensions.lookup("test@example.com") != nil {
+		t.Error("registered extension leaked into DefaultExtensions")
+	}
+	if (&ServeOptions{}).withDefaults().Extensions != DefaultExtensions {
+		t.Error("nil Extensions does not default to DefaultExtensions")
+	}
+}
@@ -14,6 +14,13 @@ type Attr struct {
 	Mode         os.FileMode
 	ATime, MTime time.Time
 	Extended     []string
+	// Attributes of SFTP version 4 and later.
+	CreateTime, CTime time.Time
+	// ACL is the encoded ACL as sent in the negotiated protocol version.
+	ACL []byte
+	// AttribBits are SFTP attrib-bits, AttribBitsValid tells which of them are
+	// set, it is only sent in SFTP version 6 and later.
+	AttribBits, AttribBitsValid uint32
 }
 
 type NamedAttr struct {
@@ -30,6 +37,70 @@ const (
 	MODE_DIR     = os.ModeDir
 )
 
+// Attr flags of SFTP version 4 and later. Clients of these versions can set ATime
+// and MTime separately, which is passed as ATTR_ATIME or ATTR_MTIME alone, both
+// of them are passed as ATTR_TIME. ATTR_OWNERGROUP is for User and Group, which
+// replace Uid and Gid in these versions.
+const (
+	ATTR_CREATETIME = ssh_FILEXFER_ATTR_CREATETIME
+	ATTR_ACL        = ssh_FILEXFER_ATTR_ACL
+	ATTR_OWNERGROUP = ssh_FILEXFER_ATTR_OWNERGROUP
+	ATTR_BITS       = ssh_FILEXFER_ATTR_BITS
+	ATTR_CTIME      = ssh_FILEXFER_ATTR_CTIME
+	ATTR_ATIME      = 0x01000000
+	ATTR_MTIME      = 0x02000000
+)
+
+// OpenFlags are the SFTP pflags of an open request. FileSystem.OpenFile receives
+// them as an uint32, OS converts them for os.OpenFile.
+type OpenFlags uint32
+
+const (
+	OPEN_READ   OpenFlags = ssh_FXF_READ
+	OPEN_WRITE  OpenFlags = ssh_FXF_WRITE
+	OPEN_APPEND OpenFlags = ssh_FXF_APPEND
+	OPEN_CREAT  OpenFlags = ssh_FXF_CREAT
+	OPEN_TRUNC  OpenFlags = ssh_FXF_TRUNC
+	OPEN_EXCL   OpenFlags = ssh_FXF_EXCL
+)
+
+// OS returns the equivalent flags for os.OpenFile.
+func (f OpenFlags) OS() int {
+	var o int
+	switch {
+	case f&OPEN_READ != 0 && f&OPEN_WRITE != 0:
+		o = os.O_RDWR
+	case f&OPEN_WRITE != 0:
+		o = os.O_WRONLY
+	default:
+		o = os.O_RDONLY
+	}
+	if f&OPEN_APPEND != 0 {
+		o |= os.O_APPEND
+	}
+	if f&OPEN_CREAT != 0 {
+		o |= os.O_CREATE
+	}
+	if f&OPEN_TRUNC != 0 {
+		o |= os.O_TRUNC
+	}
+	if f&OPEN_EXCL != 0 {
+		o |= os.O_EXCL
+	}
+	return o
+}
+
+// Flags passed to FileSystem.Rename.
+const (
+	// RENAME_OVERWRITE allows replacing an existing target.
+	// Without it Rename must fail if the target exists.
+	RENAME_OVERWRITE = ssh_FXF_RENAME_OVERWRITE
+	// RENAME_ATOMIC requests that the target is replaced atomically.
+	RENAME_ATOMIC = ssh_FXF_RENAME_ATOMIC
+	// RENAME_NATIVE allows the FileSystem to use its native rename semantics.
+	RENAME_NATIVE = ssh_FXF_RENAME_NATIVE
+)
+
 type Dir interface {
 	io.Closer
 	Readdir(count int) ([]NamedAttr, error)
@@ -42,6 +113,7 @@ type File interface {
 }
 
 type FileSystem interface {
+	// OpenFile opens a file, flags are the SFTP pflags, see OpenFlags.
 	OpenFile(name string, flags uint32, attr *Attr) (File, error)
 	OpenDir(name string) (Dir, error)
 	Remove(name string) error
@@ -64,24 +136,79 @@ func (a *Attr) FillFrom(fi os.FileInfo) {
 	a.MTime = fi.ModTime()
 }
 
+// Unix file type and mode bits used in SFTP permissions.
+const (
+	s_IFMT   = 0170000
+	s_IFSOCK = 0140000
+	s_IFLNK  = 0120000
+	s_IFREG  = 0100000
+	s_IFBLK  = 0060000
+	s_IFDIR  = 0040000
+	s_IFCHR  = 0020000
+	s_IFIFO  = 0010000
+	s_ISUID  = 0004000
+	s_ISGID  = 0002000
+	s_ISVTX  = 0001000
+)
+
 func fileModeToSftp(m os.FileMode) uint32 {
 	var raw = uint32(m.Perm())
 	switch {
 	case m.IsDir():
-		raw |= 0040000
+		raw |= s_IFDIR
+	case m&os.ModeSymlink != 0:
+		raw |= s_IFLNK
+	case m&os.ModeNamedPipe != 0:
+		raw |= s_IFIFO
+	case m&os.ModeSocket != 0:
+		raw |= s_IFSOCK
+	case m&os.ModeCharDevice != 0:
+		raw |= s_IFCHR
+	case m&os.ModeDevice != 0:
+		raw |= s_IFBLK
 	case m.IsRegular():
-		raw |= 0100000
+		raw |= s_IFREG
+	}
+	if m&os.ModeSetuid != 0 {
+		raw |= s_ISUID
+	}
+	if m&os.ModeSetgid != 0 {
+		raw |= s_ISGID
+	}
+	if m&os.ModeSticky != 0 {
+		raw |= s_ISVTX
 	}
 	return raw
 }
 
 func sftpToFileMode(raw uint32) os.FileMode {
 	var m = os.FileMode(raw & 0777)
-	switch {
-	case raw&0040000 != 0:
+	switch raw & s_IFMT {
+	case s_IFDIR:
 		m |= os.ModeDir
-	case raw&0100000 != 0:
-		// regular
+	case s_IFLNK:
+		m |= os.ModeSymlink
+	case s_IFIFO:
+		m |= os.ModeNamedPipe
+	case s_IFSOCK:
+		m |= os.ModeSocket
+	case s_IFCHR:
+		m |= os.ModeDevice | os.ModeCharDevice
+	case s_IFBLK:
+		m |= os.ModeDevice
+	case s_IFREG, 0:
+		// regular, or only permissions were sent
+	default:
+		m |= os.ModeIrregular
+	}
+	if raw&s_ISUID != 0 {
+		m |= os.ModeSetuid
+	}
+	if raw&s_ISGID != 0 {
+		m |= os.ModeSetgid
+	}
+	if raw&s_ISVTX != 0 {
+		m |= os.ModeSticky
 	}
 	return m
 }
@@ -94,19 +221,120 @@ type FileSystemExtensionFileList interface {
 	ReadDir(name string) ([]NamedAttr, error)
 }
 
+// Flags passed to FileSystem.CreateLink.
+const (
+	LINK_SYMBOLIC = 0x0
+	LINK_HARD     = 0x1
+)
+
+// StatVFS describes a mounted file system like statvfs(3).
+type StatVFS struct {
+	BlockSize    uint64 // file system block size
+	FragmentSize uint64 // fundamental block size, the unit of the block counts
+	Blocks       uint64 // size of the file system in FragmentSize units
+	BlocksFree   uint64 // free blocks
+	BlocksAvail  uint64 // free blocks available to the user
+	Files        uint64 // total number of inodes
+	FilesFree    uint64 // free inodes
+	FilesAvail   uint64 // free inodes available to the user
+	FSID         uint64 // file system id
+	Flags        uint64 // combination of STATVFS_RDONLY and STATVFS_NOSUID
+	NameMax      uint64 // maximum file name length
+}
+
+const (
+	STATVFS_RDONLY = 0x1
+	STATVFS_NOSUID = 0x2
+)
+
+// FileSystemExtensionStatVFS is an extension to report the capacity of the file system
+// containing name, e.g. the quota of a storage.
+// It is served with the statvfs@openssh.com and fstatvfs@openssh.com extensions.
+type FileSystemExtensionStatVFS interface {
+	StatVFS(name string) (*StatVFS, error)
+}
+
+// FileSystemExtensionHash is an extension to return the digest of a file range without
+// reading it, e.g. a hash already known to a cloud storage. algorithm is a name
+// used by the check-file extension like "md5", "sha1" or "sha256" and length 0
+// means up to the end of the file. Returning an error matching errors.ErrUnsupported
+// makes the server compute the digest by reading the file.
+type FileSystemExtensionHash interface {
+	Hash(name, algorithm string, offset, length uint64) ([]byte, error)
+}
+
+// FileSystemExtensionCopy is an extension to copy files on the storage without
+// transferring the data through the server. It is used by the copy-file and
+// copy-data extensions, returning an error matching errors.ErrUnsupported makes
+// the server copy the data itself.
+type FileSystemExtensionCopy interface {
+	// CopyFile copies src to dst, an existing dst is replaced only if overwrite is set.
+	CopyFile(src, dst string, overwrite bool) error
+}
+
+// FileSystemExtensionRangeReader is an extension to read files by ranges, e.g. with
+// the ranged GETs of a HTTP storage. OpenRange returns a reader of length bytes of
+// name from offset, fewer if the file ends before. At or past the end it must return
+// a reader returning io.EOF, not an error, e.g. for the 416 status of a HTTP storage.
+// Files opened only for reading are read through it, the reads of a handle at several
+// places of the file are served by one range for each place, up to four are kept
+// open. A range covers a read and the next 64 KiB, ranges continuing a sequential
+// read double in length up to 16 MiB. The reads of a handle are executed one at a
+// time, ranges are not read concurrently.
+type FileSystemExtensionRangeReader interface {
+	OpenRange(name string, offset, length uint64) (io.ReadCloser, error)
+}
+
+// FileSystemExtensionHome is an extension to give users a home directory. Relative
+// paths sent by the client are resolved against the home directory of the session
+// and "~" or "~user" are expanded by the expand-path@openssh.com and home-directory
+// extensions.
+type FileSystemExtensionHome interface {
+	// HomeDir returns the absolute home directory of user, or of the user
+	// of the session if user is empty. The session is ended if the latter fails.
+	HomeDir(user string) (string, error)
+}
+
 // FileSystemExtentionFileTransfer is a convenience extension to allow to transfer files
 // without requiring to implement the methods Create/Open/OpenFile for your custom afero.File.
 // From: github.com/fclairamb/ftpserverlib
 type FileSystemExtentionFileTransfer interface {
-	// GetHandle return an handle to upload or download a file based on flags:
+	// GetHandle return an handle to upload or download a file based on flags,
+	// the SFTP pflags like for FileSystem.OpenFile. OpenFlags(flags).OS() converts
+	// them to the os.OpenFile flags:
 	// os.O_RDONLY indicates a download
 	// os.O_WRONLY indicates an upload and can be combined with os.O_APPEND (resume) or
 	// os.O_CREATE (upload to new file/truncate)
+	// os.O_RDWR indicates a handle used for both, it is read and written through
+	// the same FileTransfer
 	//
-	// offset is the argument of a previous REST command, if any, or 0
+	// offset is the position of the first read or write, for os.O_APPEND it
+	// is the current size of the file
 	GetHandle(name string, flags uint32, attr *Attr, offset uint64) (FileTransfer, error)
 }
 
+// FileTransferExtensionSync is an optional extension of File and FileTransfer
+// to commit written data to stable storage, it is used for fsync@openssh.com.
+type FileTransferExtensionSync interface {
+	Sync() error
+}
+
+// FileTransferExtensionAbort is an optional extension of File and FileTransfer to
+// discard an upload. Handles open for writing when the session ends, because the
+// client disconnected or the server is closed, are aborted instead of closed.
+type FileTransferExtensionAbort interface {
+	Abort() error
+}
+
+// FileTransferExtensionStat is an optional extension of FileTransfer to read and
+// change the attributes of the open file, e.g. the size of an upload in progress.
+// It is used for SSH_FXP_FSTAT and SSH_FXP_FSETSTAT, File implements it. Returning
+// an error matching errors.ErrUnsupported makes the server use the path instead.
+type FileTransferExtensionStat interface {
+	FStat() (*Attr, error)
+	FSetStat(*Attr) error
+}
+
 // FileTransfer defines the inferface for file transfers.
 // From: github.com/fclairamb/ftpserverlib
 type FileTransfer interface {
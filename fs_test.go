@@ -0,0 +1,233 @@
+package sftpd
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/OpenListTeam/sftpd-openlist/binp"
+)
+
+// memFS is a FileSystem of regular files kept in memory for the tests.
+type memFS struct {
+	EmptyFS
+	mu    sync.Mutex
+	files map[string][]byte
+	// stall blocks the reads of the file named stalled until it is closed.
+	stall   chan struct{}
+	stalled string
+}
+
+func newMemFS(files map[string]string) *memFS {
+	fs := &memFS{files: map[string][]byte{}}
+	for name, data := range files {
+		fs.files[name] = []byte(data)
+	}
+	return fs
+}
+
+func (fs *memFS) content(name string) string {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return string(fs.files[name])
+}
+
+func (fs *memFS) OpenFile(name string, flags uint32, attr *Attr) (File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	_, ok := fs.files[name]
+	f := OpenFlags(flags)
+	switch {
+	case !ok && f&OPEN_CREAT == 0:
+		return nil, os.ErrNotExist
+	case ok && f&OPEN_EXCL != 0:
+		return nil, os.ErrExist
+	case !ok || f&OPEN_TRUNC != 0:
+		fs.files[name] = nil
+	}
+	return &memFile{fs: fs, name: name}, nil
+}
+
+func (fs *memFS) Stat(name string, islstat bool) (*Attr, error) {
+	if name == "/" {
+		return &Attr{Flags: ATTR_MODE, Mode: os.ModeDir | 0755}, nil
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	data, ok := fs.files[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return &Attr{Flags: ATTR_SIZE | ATTR_MODE, Size: uint64(len(data)), Mode: 0644}, nil
+}
+
+type memFile struct {
+	fs   *memFS
+	name string
+	pos  int64
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	if f.fs.stall != nil && f.name == f.fs.stalled {
+		<-f.fs.stall
+	}
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	data := f.fs.files[f.name]
+	if f.pos >= int64(len(data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, data[f.pos:])
+	f.pos += int64(n)
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	data := f.fs.files[f.name]
+	if end := f.pos + int64(len(p)); end > int64(len(data)) {
+		data = append(data, make([]byte, end-int64(len(data)))...)
+	}
+	copy(data[f.pos:], p)
+	f.fs.files[f.name] = data
+	f.pos += int64(len(p))
+	return len(p), nil
+}
+
+func (f *memFile) Seek(off int64, whence int) (int64, error) {
+	if whence != io.SeekStart {
+		return 0, os.ErrInvalid
+	}
+	f.pos = off
+	return off, nil
+}
+
+func (f *memFile) Close() error           { return nil }
+func (f *memFile) FStat() (*Attr, error)  { return f.fs.Stat(f.name, false) }
+func (f *memFile) FSetStat(a *Attr) error { return nil }
+
+// testChannel is the server side of a session driven by a testClient.
+type testChannel struct {
+	io.Reader
+	io.WriteCloser
+	r *io.PipeReader
+}
+
+func (c *testChannel) Close() error {
+	_ = c.r.Close()
+	return c.WriteCloser.Close()
+}
+func (c *testChannel) CloseWrite() error                              { return c.WriteCloser.Close() }
+func (c *testChannel) SendRequest(string, bool, []byte) (bool, error) { return false, nil }
+func (c *testChannel) Stderr() io.ReadWriter                          { return &bytes.Buffer{} }
+
+// testClient sends raw requests to a session served over pipes.
+type testClient struct {
+	t       *testing.T
+	w       *io.PipeWriter
+	replies chan []byte
+	done    chan error
+	// version is the version negotiated by the server.
+	version uint32
+}
+
+// newTestClient serves fs with opts and negotiates version.
+func newTestClient(t *testing.T, fs FileSystem, opts *ServeOptions, version uint32) *testClient {
+	sr, cw := io.Pipe()
+	cr, sw := io.Pipe()
+	c := &testClient{t: t, w: cw, replies: make(chan []byte, 64), done: make(chan error, 1)}
+	go func() {
+		c.done <- ServeChannelWithOptions(&testChannel{Reader: sr, WriteCloser: sw, r: sr}, fs, opts, func(string, ...interface{}) {})
+	}()
+	go func() {
+		defer close(c.replies)
+		brd := bufio.NewReader(cr)
+		for {
+			var hdr [4]byte
+			if _, e := io.ReadFull(brd, hdr[:]); e != nil {
+				return
+			}
+			var n uint32
+			binp.NewParser(hdr[:]).B32(&n)
+			p := make([]byte, n)
+			if _, e := io.ReadFull(brd, p); e != nil {
+				return
+			}
+			c.replies <- p
+		}
+	}()
+	c.send(ssh_FXP_INIT, binp.Out().B32(version))
+	op, data := c.recv()
+	if op != ssh_FXP_VERSION || binp.NewParser(data).B32(&c.version) == nil {
+		t.Fatalf("INIT answered with packet type %d", op)
+	}
+	return c
+}
+
+// send sends a request, o holds the data after the packet type.
+func (c *testClient) send(op byte, o *binp.Printer) {
+	var l binp.Len
+	p := binp.Out().LenB32(&l).LenStart(&l).Byte(op).Bytes(o.Out()).LenDone(&l).Out()
+	if _, e := c.w.Write(p); e != nil {
+		c.t.Fatalf("send: %v", e)
+	}
+}
+
+// recv returns the next reply, failing the test if none arrives in time.
+func (c *testClient) recv() (byte, []byte) {
+	op, data, ok := c.recvTimeout(5 * time.Second)
+	if !ok {
+		c.t.Fatal("no reply")
+	}
+	return op, data
+}
+
+// recvTimeout returns the next reply, ok is false if none arrives within d.
+func (c *testClient) recvTimeout(d time.Duration) (op byte, data []byte, ok bool) {
+	select {
+	case p, open := <-c.replies:
+		if !open || len(p) == 0 {
+			c.t.Fatal("session ended")
+		}
+		return p[0], p[1:], true
+	case <-time.After(d):
+		return 0, nil, false
+	}
+}
+
+// status returns the status code of a SSH_FXP_STATUS reply.
+func (c *testClient) status() uint32 {
+	op, data := c.recv()
+	var id, code uint32
+	if op != ssh_FXP_STATUS || binp.NewParser(data).B32(&id).B32(&code) == nil {
+		c.t.Fatalf("expected a status, got packet type %d", op)
+	}
+	return code
+}
+
+// open opens name with pflags and returns the handle.
+func (c *testClient) open(id uint32, name string, pflags uint32) string {
+	c.send(ssh_FXP_OPEN, binp.Out().B32(id).B32String(name).B32(pflags).B32(0))
+	op, data := c.recv()
+	var rid uint32
+	var h string
+	if op != ssh_FXP_HANDLE || binp.NewParser(data).B32(&rid).B32String(&h).End() != nil {
+		c.t.Fatalf("open %s: got packet type %d", name, op)
+	}
+	return h
+}
+
+// close ends the session and waits for the server to finish.
+func (c *testClient) close() {
+	_ = c.w.Close()
+	select {
+	case <-c.done:
+	case <-time.After(5 * time.Second):
+		c.t.Fatal("session did not end")
+	}
+}
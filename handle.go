@@ -1,14 +1,20 @@
 package sftpd
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"io"
-	"strconv"
+	"os"
+	"sync"
 )
 
 type FileOpenArgs struct {
 	name  string
 	flags uint32
 	attr  *Attr
+	// setstat are the attributes deferred until the handle is closed.
+	setstat *Attr
 }
 
 type DirReader struct {
@@ -35,6 +41,26 @@ func (d *DirReader) Close() error {
 	return nil
 }
 
+// openTransfer opens name positioned at offset, through GetHandle if fs
+// implements FileSystemExtentionFileTransfer and OpenFile otherwise.
+func openTransfer(fs FileSystem, name string, flags uint32, attr *Attr, offset uint64) (FileTransfer, error) {
+	if ft, ok := fs.(FileSystemExtentionFileTransfer); ok {
+		return ft.GetHandle(name, flags, attr, offset)
+	}
+	file, e := fs.OpenFile(name, flags, attr)
+	if e != nil {
+		return nil, e
+	}
+	if offset != 0 {
+		_, e = file.Seek(int64(offset), io.SeekStart)
+		if e != nil {
+			_ = file.Close()
+			return nil, e
+		}
+	}
+	return file, nil
+}
+
 type BufferedReader struct {
 	r   io.ReadSeekCloser
 	cur int64
@@ -66,6 +92,16 @@ func (b *BufferedReader) Close() error {
 	return b.r.Close()
 }
 
+// FStat calls FStat on the underlying reader if it implements FileTransferExtensionStat.
+func (b *BufferedReader) FStat() (*Attr, error) {
+	return fstat(b.r)
+}
+
+// FSetStat calls FSetStat on the underlying reader if it implements FileTransferExtensionStat.
+func (b *BufferedReader) FSetStat(a *Attr) error {
+	return fsetstat(b.r, a)
+}
+
 type WriteSeekCloser interface {
 	io.WriteSeeker
 	io.Closer
@@ -74,10 +110,21 @@ type WriteSeekCloser interface {
 type AutoSeekWriter struct {
 	w   WriteSeekCloser
 	cur int64
+	// append ignores the offset of writes, everything is written at the end.
+	append bool
+	// buf holds the writes ahead of cur if its window is not zero, so that streams
+	// that cannot seek accept writes executed out of order.
+	buf reorderBuffer
+	// noSeek is set once w failed to seek ahead, later writes ahead of cur are
+	// held without trying again.
+	noSeek bool
 }
 
 func (a *AutoSeekWriter) WriteAt(p []byte, off int64) (int, error) {
-	if off != a.cur {
+	if a.buf.window > 0 && !a.append {
+		return a.reorderWriteAt(p, off)
+	}
+	if off != a.cur && !a.append {
 		o, err := a.w.Seek(off, io.SeekStart)
 		if err != nil {
 			return 0, err
@@ -89,8 +136,172 @@ func (a *AutoSeekWriter) WriteAt(p []byte, off int64) (int, error) {
 	return n, err
 }
 
+// reorderWriteAt seeks to writes ahead of cur, they are held until the data before
+// them is written if the stream cannot seek. Writes behind cur need the stream to
+// seek back, they fail otherwise.
+func (a *AutoSeekWriter) reorderWriteAt(p []byte, off int64) (int, error) {
+	if off > a.cur && !a.noSeek {
+		o, err := a.w.Seek(off, io.SeekStart)
+		if err == nil {
+			a.cur = o
+		} else {
+			a.noSeek = true
+		}
+	}
+	if off > a.cur {
+		err := a.buf.hold(p, off)
+		if err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	if off < a.cur {
+		end := a.cur
+		_, err := a.w.Seek(off, io.SeekStart)
+		if err != nil {
+			return 0, errWriteBehind
+		}
+		n, err := a.w.Write(p)
+		if err != nil {
+			return n, err
+		}
+		if off+int64(n) >= end {
+			a.cur = off + int64(n)
+			return n, a.drain()
+		}
+		a.cur, err = a.w.Seek(end, io.SeekStart)
+		return n, err
+	}
+	n, err := a.w.Write(p)
+	a.cur += int64(n)
+	if err != nil {
+		return n, err
+	}
+	return n, a.drain()
+}
+
+// Close writes the held writes and closes the underlying writer, which is aborted
+// instead if they cannot be written.
 func (a *AutoSeekWriter) Close() error {
-	return a.w.Close()
+	err := a.flush()
+	if err != nil {
+		return errors.Join(err, a.buf.discard(), abort(a.w))
+	}
+	return errors.Join(a.w.Close(), a.buf.discard())
+}
+
+// Sync calls Sync on the underlying writer if it implements FileTransferExtensionSync.
+// The held writes are written first, Sync fails while the stream cannot seek to them.
+func (a *AutoSeekWriter) Sync() error {
+	s, ok := a.w.(FileTransferExtensionSync)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	if len(a.buf.held) > 0 {
+		if a.noSeek {
+			return errWritesHeld
+		}
+		err := a.flush()
+		if err != nil {
+			return err
+		}
+	}
+	return s.Sync()
+}
+
+// Abort aborts the underlying writer if it implements FileTransferExtensionAbort
+// and closes it otherwise.
+func (a *AutoSeekWriter) Abort() error {
+	return errors.Join(abort(a.w), a.buf.discard())
+}
+
+// FStat calls FStat on the underlying writer if it implements FileTransferExtensionStat.
+func (a *AutoSeekWriter) FStat() (*Attr, error) {
+	return fstat(a.w)
+}
+
+// FSetStat calls FSetStat on the underlying writer if it implements FileTransferExtensionStat.
+func (a *AutoSeekWriter) FSetStat(attr *Attr) error {
+	return fsetstat(a.w, attr)
+}
+
+// sharedTransfer serves the reads and writes of a READ|WRITE handle
+// through a single FileTransfer keeping one position for both.
+type sharedTransfer struct {
+	t   FileTransfer
+	cur int64
+	// end is where writes go if append is set.
+	end    int64
+	append bool
+}
+
+func (s *sharedTransfer) ReadAt(p []byte, off int64) (int, error) {
+	r := BufferedReader{r: s.t, cur: s.cur}
+	n, err := r.ReadAt(p, off)
+	s.cur = r.cur
+	return n, err
+}
+
+func (s *sharedTransfer) WriteAt(p []byte, off int64) (int, error) {
+	if s.append {
+		off = s.end
+	}
+	w := AutoSeekWriter{w: s.t, cur: s.cur}
+	n, err := w.WriteAt(p, off)
+	s.cur = w.cur
+	if s.append {
+		s.end += int64(n)
+	}
+	return n, err
+}
+
+func (s *sharedTransfer) Close() error {
+	return s.t.Close()
+}
+
+// Sync calls Sync on the FileTransfer if it implements FileTransferExtensionSync.
+func (s *sharedTransfer) Sync() error {
+	if fs, ok := s.t.(FileTransferExtensionSync); ok {
+		return fs.Sync()
+	}
+	return errors.ErrUnsupported
+}
+
+// Abort aborts the FileTransfer if it implements FileTransferExtensionAbort
+// and closes it otherwise.
+func (s *sharedTransfer) Abort() error {
+	return abort(s.t)
+}
+
+// FStat calls FStat on the FileTransfer if it implements FileTransferExtensionStat.
+func (s *sharedTransfer) FStat() (*Attr, error) {
+	return fstat(s.t)
+}
+
+// FSetStat calls FSetStat on the FileTransfer if it implements FileTransferExtensionStat.
+func (s *sharedTransfer) FSetStat(a *Attr) error {
+	return fsetstat(s.t, a)
+}
+
+func abort(c io.Closer) error {
+	if a, ok := c.(FileTransferExtensionAbort); ok {
+		return a.Abort()
+	}
+	return c.Close()
+}
+
+func fstat(t interface{}) (*Attr, error) {
+	if s, ok := t.(FileTransferExtensionStat); ok {
+		return s.FStat()
+	}
+	return nil, errors.ErrUnsupported
+}
+
+func fsetstat(t interface{}, a *Attr) error {
+	if s, ok := t.(FileTransferExtensionStat); ok {
+		return s.FSetStat(a)
+	}
+	return errors.ErrUnsupported
 }
 
 type WriteAtCloser interface {
@@ -103,65 +314,581 @@ type ReadAtCloser interface {
 	io.Closer
 }
 
+// handleIDLength is the number of random bytes of a handle, hex encoded on the wire.
+const handleIDLength = 16
+
+// handleEntry is an open file or directory handle. The reader and writer of a file
+// and the Dir of a directory are nil until opened, the reader and writer of a
+// READ|WRITE handle are the same sharedTransfer.
+type handleEntry struct {
+	// file are the open arguments of a file handle, nil for a directory.
+	file *FileOpenArgs
+	// dir is the path of a directory handle.
+	dir string
+	r   ReadAtCloser
+	w   WriteAtCloser
+	dr  Dir
+	// written is set once data has been written through the handle.
+	written bool
+}
+
+func (he *handleEntry) isDir() bool { return he.file == nil }
+
+// name returns the path of the handle.
+func (he *handleEntry) name() string {
+	if he.file != nil {
+		return he.file.name
+	}
+	return he.dir
+}
+
+// handles is the table of open handles of a session. Handles are random so that
+// clients cannot guess the ones of other requests. It is safe for concurrent use,
+// the requests of a single handle are serialized by the session.
 type handles struct {
-	f  map[string]*FileOpenArgs
-	d  map[string]string
-	fw map[string]WriteAtCloser
-	fr map[string]ReadAtCloser
-	dr map[string]Dir
-	c  int64
+	mu   sync.Mutex
+	m    map[string]*handleEntry
+	dirs int
+	opts *ServeOptions
 }
 
-func (h *handles) init() {
-	h.f = map[string]*FileOpenArgs{}
-	h.d = map[string]string{}
-	h.fw = map[string]WriteAtCloser{}
-	h.fr = map[string]ReadAtCloser{}
-	h.dr = map[string]Dir{}
+func (h *handles) init(opts *ServeOptions) {
+	h.m = map[string]*handleEntry{}
+	h.opts = opts
 }
 
-func (h *handles) closeHandle(k string) {
-	if k == "" {
-		return
+// add stores he under a new random handle if less than max handles and, for a
+// directory, less than maxDirs directory handles are open.
+func (h *handles) add(he *handleEntry, max, maxDirs int) (string, error) {
+	var b [handleIDLength]byte
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.m) >= max || he.isDir() && h.dirs >= maxDirs {
+		return "", errTooManyFiles
 	}
-	if k[0] == 'f' {
-		delete(h.f, k)
-		if c, ok := h.fw[k]; ok {
-			_ = c.Close()
-			delete(h.fw, k)
+	for {
+		_, e := rand.Read(b[:])
+		if e != nil {
+			return "", e
 		}
-		if c, ok := h.fr[k]; ok {
-			_ = c.Close()
-			delete(h.fr, k)
+		k := hex.EncodeToString(b[:])
+		if h.m[k] == nil {
+			h.m[k] = he
+			if he.isDir() {
+				h.dirs++
+			}
+			return k, nil
 		}
-	} else if k[0] == 'd' {
-		delete(h.d, k)
-		if c, ok := h.dr[k]; ok {
-			_ = c.Close()
-			delete(h.dr, k)
+	}
+}
+
+// get returns the entry of a handle, nil if it is not open.
+func (h *handles) get(k string) *handleEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.m[k]
+}
+
+// remove takes a handle out of the table and returns its entry, nil if it is not open.
+func (h *handles) remove(k string) *handleEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	he := h.m[k]
+	if he != nil {
+		delete(h.m, k)
+		if he.isDir() {
+			h.dirs--
 		}
 	}
+	return he
 }
 
-func (h *handles) nfiles() int { return len(h.f) }
+// each calls fn for every open handle until it returns false. The table is locked
+// while fn runs so it must not call other methods of h.
+func (h *handles) each(fn func(k string, he *handleEntry) bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for k, he := range h.m {
+		if !fn(k, he) {
+			return
+		}
+	}
+}
 
-func (h *handles) ndir() int { return len(h.d) }
+func (h *handles) closeHandle(fs FileSystem, k string) error {
+	he := h.remove(k)
+	if he == nil {
+		return errInvalidHandle
+	}
+	h.mu.Lock()
+	w, r, dr := he.w, he.r, he.dr
+	h.mu.Unlock()
+	var err error
+	keep := func(e error) {
+		if err == nil {
+			err = e
+		}
+	}
+	if w != nil {
+		keep(w.Close())
+	}
+	// The reader of a READ|WRITE handle is the writer.
+	if r != nil && (w == nil || io.Closer(r) != io.Closer(w)) {
+		keep(r.Close())
+	}
+	if dr != nil {
+		keep(dr.Close())
+	}
+	if err == nil && he.file != nil && he.file.setstat != nil {
+		err = fs.SetStat(he.file.name, he.file.setstat)
+	}
+	return err
+}
 
-func (h *handles) newFile(f *FileOpenArgs) string {
-	h.c++
-	k := "f" + strconv.FormatInt(h.c, 16)
-	h.f[k] = f
-	return k
+// abortAll closes the handles left open when the session ends and calls logf with
+// the path and error of those that fail. Writers are aborted rather than closed and
+// the attributes deferred until they are closed are not set.
+func (h *handles) abortAll(logf func(name string, e error)) {
+	var hes []*handleEntry
+	h.mu.Lock()
+	for k, he := range h.m {
+		hes = append(hes, he)
+		delete(h.m, k)
+	}
+	h.dirs = 0
+	h.mu.Unlock()
+	for _, he := range hes {
+		var e error
+		switch {
+		case he.w != nil:
+			e = abort(he.w)
+			if he.r != nil && io.Closer(he.r) != io.Closer(he.w) {
+				e = errors.Join(e, he.r.Close())
+			}
+		case he.r != nil:
+			e = he.r.Close()
+		case he.dr != nil:
+			e = he.dr.Close()
+		}
+		if e != nil {
+			logf(he.name(), e)
+		}
+	}
 }
-func (h *handles) newDir(f string) string {
-	h.c++
-	k := "d" + strconv.FormatInt(h.c, 16)
-	h.d[k] = f
-	return k
+
+// newFile returns a new file handle, errTooManyFiles if max handles are already open.
+func (h *handles) newFile(f *FileOpenArgs, max int) (string, error) {
+	return h.add(&handleEntry{file: f}, max, 0)
 }
+
+// newDir returns a new directory handle, errTooManyFiles if max handles or maxDirs
+// directory handles are already open.
+func (h *handles) newDir(f string, max, maxDirs int) (string, error) {
+	return h.add(&handleEntry{dir: f}, max, maxDirs)
+}
+
 func (h *handles) getFile(n string) *FileOpenArgs {
-	return h.f[n]
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if he := h.m[n]; he != nil {
+		return he.file
+	}
+	return nil
+}
+
+// getWriter returns the writer of a file handle if it has been opened.
+func (h *handles) getWriter(k string) (WriteAtCloser, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if he := h.m[k]; he != nil && he.w != nil {
+		return he.w, true
+	}
+	return nil, false
+}
+
+// markWritten records that data has been written through a handle.
+func (h *handles) markWritten(k string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if he := h.m[k]; he != nil {
+		he.written = true
+	}
+}
+
+// hasWritten reports whether data has been written through a handle.
+func (h *handles) hasWritten(k string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	he := h.m[k]
+	return he != nil && he.written
+}
+
+// dropWriter aborts the writer of a file handle that has not been written, it
+// is opened again by the next write.
+func (h *handles) dropWriter(k string) error {
+	h.mu.Lock()
+	he := h.m[k]
+	var w WriteAtCloser
+	if he != nil && !he.written {
+		w = he.w
+		he.w = nil
+		if he.r != nil && io.Closer(he.r) == io.Closer(w) {
+			he.r = nil
+		}
+	}
+	h.mu.Unlock()
+	if w == nil {
+		return nil
+	}
+	return abort(w)
+}
+
+// keepContent makes the next writer of a file handle keep the content of the
+// file, e.g. after it has been replaced by a copy.
+func (h *handles) keepContent(k string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if he := h.m[k]; he != nil && he.file != nil {
+		he.file.flags &^= uint32(OPEN_TRUNC | OPEN_EXCL)
+	}
+}
+
+// reader returns the reader of a file handle, opening it at offset on first use.
+func (h *handles) reader(fs FileSystem, k string, offset uint64) (ReadAtCloser, error) {
+	f, _, r := h.open(k)
+	if r != nil {
+		return r, nil
+	}
+	if f == nil {
+		return nil, errInvalidHandle
+	}
+	if isShared(f) {
+		return h.openShared(fs, k, f, offset)
+	}
+	if rfs, ok := fs.(FileSystemExtensionRangeReader); ok {
+		rr := &rangeReader{fs: rfs, name: f.name}
+		if e := h.set(k, rr, func(he *handleEntry) { he.r = rr }); e != nil {
+			return nil, e
+		}
+		return rr, nil
+	}
+	t, e := openTransfer(fs, f.name, f.flags, f.attr, offset)
+	if e != nil {
+		return nil, e
+	}
+	if h.opts.ReadAhead > 0 {
+		r = newReadAhead(t, int64(offset), int64(h.opts.ReadAhead))
+	} else {
+		r = &BufferedReader{r: t, cur: int64(offset)}
+	}
+	e = h.set(k, t, func(he *handleEntry) { he.r = r })
+	if e != nil {
+		return nil, e
+	}
+	return r, nil
+}
+
+// writer returns the writer of a file handle, opening it at offset on first use.
+// Handles opened with APPEND are opened at the end of the file.
+func (h *handles) writer(fs FileSystem, k string, offset uint64) (WriteAtCloser, error) {
+	f, w, _ := h.open(k)
+	if w != nil {
+		return w, nil
+	}
+	if f == nil {
+		return nil, errInvalidHandle
+	}
+	if isShared(f) {
+		return h.openShared(fs, k, f, offset)
+	}
+	appending := OpenFlags(f.flags)&OPEN_APPEND != 0
+	if appending && OpenFlags(f.flags)&OPEN_TRUNC == 0 {
+		var e error
+		offset, e = fileSize(fs, f.name)
+		if e != nil {
+			return nil, e
+		}
+	}
+	t, e := openTransfer(fs, f.name, f.flags, f.attr, offset)
+	if e != nil {
+		return nil, e
+	}
+	aw := &AutoSeekWriter{w: t, cur: int64(offset), append: appending}
+	aw.buf.window = int(h.opts.WriteReorderWindow)
+	aw.buf.spillLimit = int64(h.opts.MaxReorderSpill)
+	w = aw
+	e = h.set(k, t, func(he *handleEntry) { he.w = w })
+	if e != nil {
+		return nil, e
+	}
+	return w, nil
+}
+
+// set stores what was opened for a handle with fn. If the handle was closed
+// meanwhile c is closed and errInvalidHandle returned.
+func (h *handles) set(k string, c io.Closer, fn func(he *handleEntry)) error {
+	h.mu.Lock()
+	he := h.m[k]
+	if he != nil {
+		fn(he)
+	}
+	h.mu.Unlock()
+	if he == nil {
+		_ = c.Close()
+		return errInvalidHandle
+	}
+	return nil
+}
+
+// openEager opens the backend of a new file handle while serving SSH_FXP_OPEN so
+// that errors are reported there and created files exist even if never written.
+// A FileTransfer is positioned by the offset of the first read or write, so it is
+// only opened for uploads starting at zero. Its reads and those served by ranges
+// are checked with Stat instead.
+func (h *handles) openEager(fs FileSystem, k string) error {
+	f := h.getFile(k)
+	if f == nil {
+		return errInvalidHandle
+	}
+	flags := OpenFlags(f.flags)
+	_, transfer := fs.(FileSystemExtentionFileTransfer)
+	_, ranged := fs.(FileSystemExtensionRangeReader)
+	var e error
+	switch {
+	case flags&OPEN_WRITE != 0 && (!transfer || flags&(OPEN_TRUNC|OPEN_EXCL) != 0):
+		_, e = h.writer(fs, k, 0)
+	case flags&OPEN_WRITE == 0 && (transfer || ranged):
+		_, e = fs.Stat(f.name, false)
+	case !transfer:
+		_, e = h.reader(fs, k, 0)
+	}
+	return e
+}
+
+// deferSetStat queues the attributes except the size for the write handles of name,
+// or only for the handle k if it is not empty, to be set when they are closed. It
+// returns the attributes to set now, nil if no handle was found.
+func (h *handles) deferSetStat(k, name string, a *Attr) *Attr {
+	later := *a
+	later.Flags &^= ATTR_SIZE
+	if later.Flags == 0 {
+		return nil
+	}
+	deferred := false
+	h.each(func(fk string, he *handleEntry) bool {
+		f := he.file
+		if f != nil && (fk == k || k == "" && f.name == name) && OpenFlags(f.flags)&OPEN_WRITE != 0 {
+			f.setstat = mergeAttr(f.setstat, &later)
+			deferred = true
+		}
+		return true
+	})
+	if !deferred {
+		return nil
+	}
+	return &Attr{Flags: a.Flags & ATTR_SIZE, Size: a.Size}
+}
+
+// mergeAttr returns dst with the attributes set in src replaced, dst may be nil.
+func mergeAttr(dst, src *Attr) *Attr {
+	if dst == nil {
+		c := *src
+		return &c
+	}
+	f := src.Flags
+	if f&ATTR_SIZE != 0 {
+		dst.Size = src.Size
+	}
+	if f&ATTR_UIDGID != 0 {
+		dst.Uid, dst.Gid = src.Uid, src.Gid
+	}
+	if f&ATTR_OWNERGROUP != 0 {
+		dst.User, dst.Group = src.User, src.Group
+	}
+	if f&ATTR_MODE != 0 {
+		dst.Mode = src.Mode
+	}
+	if f&(ATTR_TIME|ATTR_ATIME) != 0 {
+		dst.ATime = src.ATime
+	}
+	if f&(ATTR_TIME|ATTR_MTIME) != 0 {
+		dst.MTime = src.MTime
+	}
+	if f&ATTR_CREATETIME != 0 {
+		dst.CreateTime = src.CreateTime
+	}
+	if f&ATTR_CTIME != 0 {
+		dst.CTime = src.CTime
+	}
+	if f&ATTR_ACL != 0 {
+		dst.ACL = src.ACL
+	}
+	if f&ATTR_BITS != 0 {
+		dst.AttribBits, dst.AttribBitsValid = src.AttribBits, src.AttribBitsValid
+	}
+	if f&ssh_FILEXFER_ATTR_EXTENDED != 0 {
+		dst.Extended = src.Extended
+	}
+	dst.Flags |= f
+	if dst.Flags&(ATTR_TIME|ATTR_ATIME|ATTR_MTIME) == ATTR_ATIME|ATTR_MTIME || dst.Flags&ATTR_TIME != 0 {
+		dst.Flags = dst.Flags&^(ATTR_ATIME|ATTR_MTIME) | ATTR_TIME
+	}
+	return dst
+}
+
+// fstat returns the attributes of a file handle from its open writer or reader,
+// or from its path if neither is open or supports FileTransferExtensionStat.
+func (h *handles) fstat(fs FileSystem, k string) (*Attr, error) {
+	f, w, r := h.open(k)
+	if f == nil {
+		return nil, errInvalidHandle
+	}
+	// The writer comes first, it knows the size of an upload in progress.
+	for _, t := range []interface{}{w, r} {
+		a, e := fstat(t)
+		if !errors.Is(e, errors.ErrUnsupported) {
+			return a, e
+		}
+	}
+	return fs.Stat(f.name, false)
 }
+
+// fsetstat changes the attributes of a file handle like fstat reads them.
+func (h *handles) fsetstat(fs FileSystem, k string, a *Attr) error {
+	f, w, r := h.open(k)
+	if f == nil {
+		return errInvalidHandle
+	}
+	for _, t := range []interface{}{w, r} {
+		e := fsetstat(t, a)
+		if !errors.Is(e, errors.ErrUnsupported) {
+			return e
+		}
+	}
+	return fs.SetStat(f.name, a)
+}
+
+// open returns a file handle with its writer and reader, which are nil until opened.
+func (h *handles) open(k string) (*FileOpenArgs, WriteAtCloser, ReadAtCloser) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if he := h.m[k]; he != nil && he.file != nil {
+		return he.file, he.w, he.r
+	}
+	return nil, nil, nil
+}
+
+// isShared reports whether a handle is read and written through one stream.
+func isShared(f *FileOpenArgs) bool {
+	flags := OpenFlags(f.flags)
+	return flags&OPEN_READ != 0 && flags&OPEN_WRITE != 0
+}
+
+// openShared opens the single stream of a READ|WRITE handle and uses it as reader and writer.
+func (h *handles) openShared(fs FileSystem, k string, f *FileOpenArgs, offset uint64) (*sharedTransfer, error) {
+	st := &sharedTransfer{append: OpenFlags(f.flags)&OPEN_APPEND != 0}
+	if st.append && OpenFlags(f.flags)&OPEN_TRUNC == 0 {
+		size, e := fileSize(fs, f.name)
+		if e != nil {
+			return nil, e
+		}
+		st.end = int64(size)
+	}
+	t, e := openTransfer(fs, f.name, f.flags, f.attr, offset)
+	if e != nil {
+		return nil, e
+	}
+	st.t = t
+	st.cur = int64(offset)
+	e = h.set(k, t, func(he *handleEntry) { he.r, he.w = st, st })
+	if e != nil {
+		return nil, e
+	}
+	return st, nil
+}
+
+// fileSize returns the size of name, zero if it does not exist yet.
+func fileSize(fs FileSystem, name string) (uint64, error) {
+	a, e := fs.Stat(name, false)
+	if os.IsNotExist(e) {
+		return 0, nil
+	}
+	if e != nil {
+		return 0, e
+	}
+	return a.Size, nil
+}
+
+// checkOpen enforces the semantics of the open flags the FileSystem may not:
+// EXCL fails if the file exists and writing without CREAT needs an existing file.
+func checkOpen(fs FileSystem, name string, flags OpenFlags) error {
+	switch {
+	case flags&OPEN_EXCL != 0:
+		_, e := fs.Stat(name, false)
+		if e == nil {
+			return &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+		}
+		if !os.IsNotExist(e) {
+			return e
+		}
+	case flags&OPEN_WRITE != 0 && flags&OPEN_CREAT == 0:
+		_, e := fs.Stat(name, false)
+		return e
+	}
+	return nil
+}
+
 func (h *handles) getDir(n string) string {
-	return h.d[n]
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if he := h.m[n]; he != nil {
+		return he.dir
+	}
+	return ""
+}
+
+// dirReader returns the Dir of a directory handle, listing the directory on first use.
+func (h *handles) dirReader(fs FileSystem, k string) (Dir, error) {
+	h.mu.Lock()
+	var dr Dir
+	var name string
+	he := h.m[k]
+	if he != nil {
+		dr, name = he.dr, he.dir
+	}
+	h.mu.Unlock()
+	if dr != nil {
+		return dr, nil
+	}
+	if he == nil || !he.isDir() {
+		return nil, errInvalidHandle
+	}
+	if frd, ok := fs.(FileSystemExtensionFileList); ok {
+		fis, e := frd.ReadDir(name)
+		if e != nil {
+			return nil, e
+		}
+		dr = &DirReader{attrs: fis}
+	} else {
+		var e error
+		dr, e = fs.OpenDir(name)
+		if e != nil {
+			return nil, e
+		}
+	}
+	e := h.set(k, dr, func(he *handleEntry) { he.dr = dr })
+	if e != nil {
+		return nil, e
+	}
+	return dr, nil
+}
+
+// getName returns the path of a file or directory handle.
+func (h *handles) getName(n string) (string, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if he := h.m[n]; he != nil {
+		return he.name(), true
+	}
+	return "", false
 }
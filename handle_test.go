@@ -0,0 +1,35 @@
+package sftpd
+
+import (
+	"os"
+	"testing"
+)
+
+// transferFS is a memFS implementing FileSystemExtentionFileTransfer which
+// records the flags passed to GetHandle.
+type transferFS struct {
+	*memFS
+	flags uint32
+}
+
+func (fs *transferFS) GetHandle(name string, flags uint32, attr *Attr, offset uint64) (FileTransfer, error) {
+	fs.flags = flags
+	return fs.OpenFile(name, flags, attr)
+}
+
+func TestGetHandleFlags(t *testing.T) {
+	fs := &transferFS{memFS: newMemFS(nil)}
+	for _, flags := range []OpenFlags{OPEN_READ | OPEN_CREAT, OPEN_WRITE | OPEN_CREAT | OPEN_TRUNC, OPEN_WRITE | OPEN_APPEND | OPEN_CREAT} {
+		ft, e := openTransfer(fs, "/f", uint32(flags), &Attr{}, 0)
+		if e != nil {
+			t.Fatalf("openTransfer(%#x): %v", flags, e)
+		}
+		_ = ft.Close()
+		if fs.flags != uint32(flags) {
+			t.Errorf("GetHandle got flags %#x, want the pflags %#x", fs.flags, flags)
+		}
+	}
+	if OpenFlags(OPEN_WRITE|OPEN_CREAT).OS() != os.O_WRONLY|os.O_CREATE {
+		t.Errorf("OpenFlags.OS() = %#x", OpenFlags(OPEN_WRITE|OPEN_CREAT).OS())
+	}
+}
@@ -0,0 +1,95 @@
+package sftpd
+
+import (
+	"path"
+	"strings"
+
+	"github.com/OpenListTeam/sftpd-openlist/binp"
+)
+
+func init() {
+	builtinExtension("expand-path@openssh.com", "1", expandPath, supportsHome)
+	builtinExtension("home-directory", "1", homeDirectory, supportsHome)
+}
+
+func supportsHome(fs FileSystem) bool {
+	_, ok := fs.(FileSystemExtensionHome)
+	return ok
+}
+
+// homeDir is the home directory of a session, empty if the FileSystem has none.
+type homeDir string
+
+// sessionHome returns the home directory of the user of the session.
+func sessionHome(fs FileSystem) (homeDir, error) {
+	hfs, ok := fs.(FileSystemExtensionHome)
+	if !ok {
+		return "", nil
+	}
+	home, e := hfs.HomeDir("")
+	if e != nil {
+		return "", e
+	}
+	return homeDir(home), nil
+}
+
+// abs resolves a relative path against the home directory.
+func (h homeDir) abs(p string) string {
+	if h == "" || path.IsAbs(p) {
+		return p
+	}
+	return path.Join(string(h), p)
+}
+
+// composePath appends a compose-path of a SFTPv6 SSH_FXP_REALPATH request to p.
+func composePath(p, compose string) string {
+	if path.IsAbs(compose) {
+		return compose
+	}
+	return path.Join(p, compose)
+}
+
+// expandPath implements expand-path@openssh.com, a REALPATH that expands "~" and "~user".
+func expandPath(r *ExtendedRequest) ([]byte, error) {
+	var p string
+	e := binp.NewParser(r.Data).B32String(&p).End()
+	if e != nil {
+		return nil, e
+	}
+	if strings.HasPrefix(p, "~") {
+		user, rest, _ := strings.Cut(p[1:], "/")
+		var home string
+		home, e = r.FileSystem.(FileSystemExtensionHome).HomeDir(user)
+		if e != nil {
+			return nil, e
+		}
+		p = path.Join(home, rest)
+	}
+	p, e = r.FileSystem.RealPath(r.Path(p))
+	if e != nil {
+		return nil, e
+	}
+	return nameReply(r, p), nil
+}
+
+// homeDirectory implements home-directory returning the home directory of a user.
+func homeDirectory(r *ExtendedRequest) ([]byte, error) {
+	var user string
+	e := binp.NewParser(r.Data).B32String(&user).End()
+	if e != nil {
+		return nil, e
+	}
+	home, e := r.FileSystem.(FileSystemExtensionHome).HomeDir(user)
+	if e != nil {
+		return nil, e
+	}
+	return nameReply(r, home), nil
+}
+
+// nameReply makes r answer with a SSH_FXP_NAME packet containing only the path.
+func nameReply(r *ExtendedRequest, p string) []byte {
+	r.replyType = ssh_FXP_NAME
+	o := binp.Out().B32(1)
+	outName(o, p, p, &Attr{}, r.version)
+	return o.Out()
+}
@@ -0,0 +1,25 @@
+package sftpd
+
+import (
+	"errors"
+	"io"
+	"testing"
+)
+
+// failingHomeFS is a FileSystem whose home directory lookup fails.
+type failingHomeFS struct {
+	EmptyFS
+}
+
+var errNoHome = errors.New("no home")
+
+func (failingHomeFS) HomeDir(user string) (string, error) { return "", errNoHome }
+
+func TestSessionFailsWithoutHome(t *testing.T) {
+	sr, _ := io.Pipe()
+	_, sw := io.Pipe()
+	e := ServeChannelWithOptions(&testChannel{Reader: sr, WriteCloser: sw, r: sr}, failingHomeFS{}, nil, func(string, ...interface{}) {})
+	if e != errNoHome {
+		t.Errorf("ServeChannelWithOptions = %v, want %v", e, errNoHome)
+	}
+}
@@ -19,6 +19,8 @@ type Config struct {
 	// DebugLogFunc is used to log debug infos.
 	// e.g. log.Printf has the right type.
 	DebugLogFunc DebugLogger
+	// ServeOptions are used for every served sftp channel.
+	ServeOptions
 }
 
 type SftpDriver interface {
@@ -114,7 +116,9 @@ func doHandleConn(conn net.Conn, server *SftpServer) error {
 							} else {
 								debugf = func(s string, v ...interface{}) {}
 							}
-							e = ServeChannel(channel, fs, debugf)
+							opts := server.driver.GetConfig().ServeOptions
+							opts.errorLog = server.LogError
+							e = ServeChannelWithOptions(channel, fs, &opts, debugf)
 						}
 						if e != nil {
 							server.LogError("sftpd servechannel failed:", e)
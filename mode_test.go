@@ -0,0 +1,75 @@
+package sftpd
+
+import (
+	"os"
+	"testing"
+
+	"github.com/OpenListTeam/sftpd-openlist/binp"
+)
+
+var modeTests = []struct {
+	mode os.FileMode
+	raw  uint32
+	ls   string
+}{
+	{0644, s_IFREG | 0644, "-rw-r--r--"},
+	{os.ModeDir | 0755, s_IFDIR | 0755, "drwxr-xr-x"},
+	{os.ModeSymlink | 0777, s_IFLNK | 0777, "lrwxrwxrwx"},
+	{os.ModeNamedPipe | 0600, s_IFIFO | 0600, "prw-------"},
+	{os.ModeSocket | 0755, s_IFSOCK | 0755, "srwxr-xr-x"},
+	{os.ModeDevice | os.ModeCharDevice | 0620, s_IFCHR | 0620, "crw--w----"},
+	{os.ModeDevice | 0660, s_IFBLK | 0660, "brw-rw----"},
+	{os.ModeSetuid | 0755, s_IFREG | s_ISUID | 0755, "-rwsr-xr-x"},
+	{os.ModeSetuid | 0644, s_IFREG | s_ISUID | 0644, "-rwSr--r--"},
+	{os.ModeSetgid | 0755, s_IFREG | s_ISGID | 0755, "-rwxr-sr-x"},
+	{os.ModeSetgid | 0744, s_IFREG | s_ISGID | 0744, "-rwxr-Sr--"},
+	{os.ModeDir | os.ModeSticky | 0777, s_IFDIR | s_ISVTX | 0777, "drwxrwxrwt"},
+	{os.ModeDir | os.ModeSticky | 0770, s_IFDIR | s_ISVTX | 0770, "drwxrwx--T"},
+	{os.ModeDir | os.ModeSetgid | os.ModeSticky | 0775, s_IFDIR | s_ISGID | s_ISVTX | 0775, "drwxrwsr-t"},
+}
+
+func TestFileModeToSftp(t *testing.T) {
+	for _, tt := range modeTests {
+		if raw := fileModeToSftp(tt.mode); raw != tt.raw {
+			t.Errorf("fileModeToSftp(%v) = %o, want %o", tt.mode, raw, tt.raw)
+		}
+		if m := sftpToFileMode(tt.raw); m != tt.mode {
+			t.Errorf("sftpToFileMode(%o) = %v, want %v", tt.raw, m, tt.mode)
+		}
+	}
+}
+
+func TestSftpToFileModeOnlyPermissions(t *testing.T) {
+	if m := sftpToFileMode(0644); m != 0644 {
+		t.Errorf("sftpToFileMode(0644) = %v, want -rw-r--r--", m)
+	}
+	if m := sftpToFileMode(0170000 | 0644); m != os.ModeIrregular|0644 {
+		t.Errorf("sftpToFileMode of an unknown type = %v, want irregular", m)
+	}
+}
+
+func TestLsMode(t *testing.T) {
+	for _, tt := range modeTests {
+		if s := lsMode(tt.mode); s != tt.ls {
+			t.Errorf("lsMode(%v) = %q, want %q", tt.mode, s, tt.ls)
+		}
+	}
+}
+
+func TestAttrModeRoundTrip(t *testing.T) {
+	for _, version := range []uint32{3, 6} {
+		for _, tt := range modeTests {
+			o := binp.Out()
+			outAttr(o, &Attr{Flags: ATTR_MODE, Mode: tt.mode}, version)
+			var a Attr
+			e := parseAttr(binp.NewParser(o.Out()), &a, version).End()
+			if e != nil {
+				t.Errorf("v%d %v: parseAttr: %v", version, tt.mode, e)
+				continue
+			}
+			if a.Flags&ATTR_MODE == 0 || a.Mode != tt.mode {
+				t.Errorf("v%d %v: got mode %v flags %#x", version, tt.mode, a.Mode, a.Flags)
+			}
+		}
+	}
+}
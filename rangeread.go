@@ -0,0 +1,143 @@
+package sftpd
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// maxRangeStreams is the number of ranges a download handle keeps open at the same time.
+const maxRangeStreams = 4
+
+// maxRangeSkip is the largest gap read through and discarded to reuse a range
+// instead of opening another one.
+const maxRangeSkip = 64 * 1024
+
+// maxRangeLength is the length ranges continuing a sequential read grow up to.
+const maxRangeLength = 16 * 1024 * 1024
+
+// rangeStream is an open range of a file positioned at pos and ending at end.
+type rangeStream struct {
+	rc     io.ReadCloser
+	pos    int64
+	end    int64
+	length int64
+	// eof is set once the file ended before the end of the range.
+	eof bool
+	// used orders the ranges by last use to replace the least recently used one.
+	used int64
+}
+
+// rangeReader serves the reads of a download handle from ranges opened with a
+// FileSystemExtensionRangeReader. Each read continues the range ending where it
+// starts, so that clients reading at several places at once, like sshfs or video
+// players seeking through a file, are served by one range for each place. The
+// reads of a handle are executed in order, one at a time.
+type rangeReader struct {
+	fs   FileSystemExtensionRangeReader
+	name string
+
+	mu      sync.Mutex
+	streams []*rangeStream
+	uses    int64
+}
+
+func (rr *rangeReader) ReadAt(p []byte, off int64) (int, error) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	s, e := rr.stream(off, int64(len(p)))
+	if e != nil {
+		return 0, e
+	}
+	rr.uses++
+	s.used = rr.uses
+	if s.eof && off >= s.pos {
+		return 0, io.EOF
+	}
+	if off > s.pos {
+		n, e := io.CopyN(io.Discard, s.rc, off-s.pos)
+		s.pos += n
+		if e == io.EOF {
+			s.eof = true
+		}
+		if e != nil {
+			return 0, rr.failed(s, e)
+		}
+	}
+	n, e := io.ReadFull(s.rc, p)
+	s.pos += int64(n)
+	if e == io.ErrUnexpectedEOF || e == io.EOF {
+		// The range covers p, it ends early only at the end of the file.
+		s.eof = true
+		e = io.EOF
+	}
+	return n, rr.failed(s, e)
+}
+
+// stream returns the range with the smallest gap before off covering length
+// bytes from off. A range within maxRangeSkip that is too short is replaced by
+// one twice as long, opening a new one otherwise covers the read and maxRangeSkip.
+func (rr *rangeReader) stream(off, length int64) (*rangeStream, error) {
+	var best *rangeStream
+	for _, s := range rr.streams {
+		if s.pos <= off && off-s.pos <= maxRangeSkip && (best == nil || s.pos > best.pos) {
+			best = s
+		}
+	}
+	if best != nil && (best.eof || off+length <= best.end) {
+		return best, nil
+	}
+	n := length + maxRangeSkip
+	if best != nil {
+		n = max(n, min(2*best.length, maxRangeLength))
+	}
+	rc, e := rr.fs.OpenRange(rr.name, uint64(off), uint64(n))
+	if e != nil {
+		return nil, e
+	}
+	if best != nil {
+		_ = best.rc.Close()
+		*best = rangeStream{rc: rc, pos: off, end: off + n, length: n}
+		return best, nil
+	}
+	if len(rr.streams) >= maxRangeStreams {
+		lru := 0
+		for i, s := range rr.streams {
+			if s.used < rr.streams[lru].used {
+				lru = i
+			}
+		}
+		_ = rr.streams[lru].rc.Close()
+		rr.streams = append(rr.streams[:lru], rr.streams[lru+1:]...)
+	}
+	s := &rangeStream{rc: rc, pos: off, end: off + n, length: n}
+	rr.streams = append(rr.streams, s)
+	return s, nil
+}
+
+// failed closes and forgets s if e is an error other than io.EOF, a range at
+// the end of the file is kept to answer the reads past it. It returns e.
+func (rr *rangeReader) failed(s *rangeStream, e error) error {
+	if e == nil || e == io.EOF {
+		return e
+	}
+	_ = s.rc.Close()
+	for i, o := range rr.streams {
+		if o == s {
+			rr.streams = append(rr.streams[:i], rr.streams[i+1:]...)
+			break
+		}
+	}
+	return e
+}
+
+func (rr *rangeReader) Close() error {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	var err error
+	for _, s := range rr.streams {
+		err = errors.Join(err, s.rc.Close())
+	}
+	rr.streams = nil
+	return err
+}
@@ -0,0 +1,89 @@
+package sftpd
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+// rangeFS is a memFS serving ranges, it records the ranges opened.
+type rangeFS struct {
+	*memFS
+	ranges [][2]uint64
+}
+
+func (fs *rangeFS) OpenRange(name string, offset, length uint64) (io.ReadCloser, error) {
+	fs.ranges = append(fs.ranges, [2]uint64{offset, length})
+	data := []byte(fs.content(name))
+	offset = min(offset, uint64(len(data)))
+	return io.NopCloser(bytes.NewReader(data[offset:min(offset+length, uint64(len(data)))])), nil
+}
+
+func TestRangeReaderSequential(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 100000)
+	fs := &rangeFS{memFS: newMemFS(map[string]string{"/f": string(data)})}
+	rr := &rangeReader{fs: fs, name: "/f"}
+	defer rr.Close()
+	var got []byte
+	p := make([]byte, 32*1024)
+	for off := int64(0); ; off += int64(len(p)) {
+		n, e := rr.ReadAt(p, off)
+		got = append(got, p[:n]...)
+		if e == io.EOF {
+			break
+		}
+		if e != nil {
+			t.Fatalf("ReadAt(%d): %v", off, e)
+		}
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("read %d bytes differing from the file", len(got))
+	}
+	if n, e := rr.ReadAt(p, int64(len(data))); n != 0 || e != io.EOF {
+		t.Errorf("ReadAt at the end = %d, %v, want EOF", n, e)
+	}
+	want := uint64(32*1024 + maxRangeSkip)
+	for i, r := range fs.ranges {
+		if r[1] != want {
+			t.Errorf("range %d: length %d, want %d", i, r[1], want)
+		}
+		want = min(2*want, maxRangeLength)
+	}
+	if len(fs.ranges) > 5 {
+		t.Errorf("%d ranges opened for a sequential read of %d bytes", len(fs.ranges), len(data))
+	}
+}
+
+func TestRangeReaderRandom(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	data := make([]byte, 300000)
+	rnd.Read(data)
+	fs := &rangeFS{memFS: newMemFS(map[string]string{"/f": string(data)})}
+	rr := &rangeReader{fs: fs, name: "/f"}
+	defer rr.Close()
+	// Several places of the file read sequentially in turn.
+	places := []int64{0, 100000, 200000, 250000}
+	for i := 0; i < 400; i++ {
+		k := rnd.Intn(len(places))
+		if rnd.Intn(20) == 0 {
+			places[k] = rnd.Int63n(int64(len(data)) + 100)
+		}
+		off, length := places[k], 1+rnd.Intn(40000)
+		p := make([]byte, length)
+		n, e := rr.ReadAt(p, off)
+		want := max(0, min(int64(length), int64(len(data))-off))
+		if int64(n) != want || !bytes.Equal(p[:n], data[min(off, int64(len(data))):][:n]) {
+			t.Fatalf("ReadAt(%d, %d) = %d bytes, want %d matching the file", length, off, n, want)
+		}
+		if int64(n) < int64(length) && e != io.EOF || int64(n) == int64(length) && e != nil {
+			t.Fatalf("ReadAt(%d, %d): %v", length, off, e)
+		}
+		places[k] = off + int64(n)
+	}
+	for _, r := range fs.ranges {
+		if r[1] == 0 || r[1] > maxRangeLength {
+			t.Errorf("range at %d has length %d", r[0], r[1])
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package sftpd
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// readAheadChunk is the size of the reads of the backend by the prefetcher.
+const readAheadChunk = 64 * 1024
+
+// readAhead serves the reads of a download from data prefetched in the background,
+// overlapping the latency of the backend with the transfer to the client. It keeps
+// a window of data before and after the last read, reads within it are served from
+// memory and only reads outside of it seek the backend.
+type readAhead struct {
+	r io.ReadSeekCloser
+	// window is the data prefetched ahead of the last read, a quarter of it is
+	// kept behind it for reads arriving late.
+	window int64
+
+	// io serializes the calls to r by the prefetcher and FStat or FSetStat.
+	io sync.Mutex
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// buf is the data from off to pos, pos is the position of r.
+	buf []byte
+	off int64
+	pos int64
+	// next is where the next read is expected and want the end of the data
+	// a read is waiting for.
+	next int64
+	want int64
+	// err is the error of reading r at pos.
+	err error
+	// gen changes when r is seeked, data prefetched before is dropped.
+	gen      int
+	fetching bool
+	seeking  bool
+	closed   bool
+}
+
+func newReadAhead(r io.ReadSeekCloser, offset int64, window int64) *readAhead {
+	ra := &readAhead{r: r, window: window, off: offset, pos: offset, next: offset}
+	ra.cond = sync.NewCond(&ra.mu)
+	return ra
+}
+
+func (ra *readAhead) ReadAt(p []byte, off int64) (int, error) {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	for {
+		if ra.closed {
+			return 0, os.ErrClosed
+		}
+		// Past the end of the file there is nothing to seek to.
+		if off >= ra.pos && ra.err == io.EOF {
+			return 0, io.EOF
+		}
+		// Concurrent reads may have dropped the data at off while waiting.
+		if off < ra.off || off > ra.pos+ra.window {
+			e := ra.seek(off)
+			if e != nil {
+				return 0, e
+			}
+		}
+		ra.next = max(ra.next, off)
+		n := 0
+		if off < ra.pos {
+			n = copy(p, ra.buf[off-ra.off:])
+		}
+		if n == len(p) || ra.err != nil {
+			ra.next, ra.want = off+int64(n), 0
+			ra.trim()
+			ra.fetch()
+			if n < len(p) {
+				return n, ra.err
+			}
+			return n, nil
+		}
+		ra.want = off + int64(len(p))
+		ra.fetch()
+		ra.cond.Wait()
+	}
+}
+
+// seek moves r to off dropping the prefetched data, the lock is held.
+// It waits for the prefetcher to stop first.
+func (ra *readAhead) seek(off int64) error {
+	ra.seeking = true
+	ra.gen++
+	for ra.fetching {
+		ra.cond.Wait()
+	}
+	o, e := ra.r.Seek(off, io.SeekStart)
+	ra.seeking = false
+	ra.buf = ra.buf[:0]
+	ra.off, ra.pos, ra.next, ra.err = o, o, o, e
+	return e
+}
+
+// trim drops the data more than a quarter of the window before the next read.
+func (ra *readAhead) trim() {
+	if keep := ra.next - ra.window/4; keep > ra.off {
+		keep = min(keep, ra.pos)
+		ra.buf = ra.buf[keep-ra.off:]
+		ra.off = keep
+	}
+}
+
+// room reports whether the prefetcher should read more, the lock is held.
+func (ra *readAhead) room() bool {
+	return !ra.closed && !ra.seeking && ra.err == nil && (ra.pos < ra.next+ra.window || ra.pos < ra.want)
+}
+
+// fetch starts the prefetcher if it is not running and there is room, the lock is held.
+func (ra *readAhead) fetch() {
+	if ra.fetching || !ra.room() {
+		return
+	}
+	ra.fetching = true
+	go ra.prefetch()
+}
+
+// prefetch reads r in chunks until the window is full.
+func (ra *readAhead) prefetch() {
+	chunk := make([]byte, readAheadChunk)
+	for {
+		ra.mu.Lock()
+		if !ra.room() {
+			ra.fetching = false
+			ra.mu.Unlock()
+			ra.cond.Broadcast()
+			return
+		}
+		gen := ra.gen
+		n := int(min(int64(len(chunk)), max(ra.next+ra.window, ra.want)-ra.pos))
+		ra.mu.Unlock()
+		ra.io.Lock()
+		n, e := ra.r.Read(chunk[:n])
+		ra.io.Unlock()
+		ra.mu.Lock()
+		if gen == ra.gen {
+			ra.buf = append(ra.buf, chunk[:n]...)
+			ra.pos += int64(n)
+			ra.err = e
+		}
+		ra.mu.Unlock()
+		ra.cond.Broadcast()
+	}
+}
+
+// Close waits for the prefetcher to stop and closes the underlying reader.
+func (ra *readAhead) Close() error {
+	ra.mu.Lock()
+	ra.closed = true
+	for ra.fetching {
+		ra.cond.Wait()
+	}
+	ra.mu.Unlock()
+	return ra.r.Close()
+}
+
+// FStat calls FStat on the underlying reader if it implements FileTransferExtensionStat.
+func (ra *readAhead) FStat() (*Attr, error) {
+	ra.io.Lock()
+	defer ra.io.Unlock()
+	return fstat(ra.r)
+}
+
+// FSetStat calls FSetStat on the underlying reader if it implements FileTransferExtensionStat.
+func (ra *readAhead) FSetStat(a *Attr) error {
+	ra.io.Lock()
+	defer ra.io.Unlock()
+	return fsetstat(ra.r, a)
+}
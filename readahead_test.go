@@ -0,0 +1,94 @@
+package sftpd
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+// shortReader is a ReadSeekCloser over data returning reads of random length.
+type shortReader struct {
+	*bytes.Reader
+	rnd *rand.Rand
+	mu  sync.Mutex
+}
+
+func (r *shortReader) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	n := 1 + r.rnd.Intn(len(p))
+	r.mu.Unlock()
+	return r.Reader.Read(p[:n])
+}
+
+func (r *shortReader) Close() error { return nil }
+
+// checkReadAt compares a ReadAt of ra with data.
+func checkReadAt(t *testing.T, ra *readAhead, data []byte, off int64, length int) {
+	p := make([]byte, length)
+	n, e := ra.ReadAt(p, off)
+	want := 0
+	if off < int64(len(data)) {
+		want = copy(make([]byte, length), data[off:])
+	}
+	if n != want || !bytes.Equal(p[:n], data[min(off, int64(len(data))):][:n]) {
+		t.Errorf("ReadAt(%d, %d) = %d bytes, want %d matching the file", length, off, n, want)
+	}
+	if n < length && e != io.EOF {
+		t.Errorf("ReadAt(%d, %d) short read with %v, want EOF", length, off, e)
+	}
+	if n == length && e != nil {
+		t.Errorf("ReadAt(%d, %d): %v", length, off, e)
+	}
+}
+
+func TestReadAheadRandom(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	data := make([]byte, 1<<20+123)
+	rnd.Read(data)
+	for _, window := range []int64{4096, 100000, 2 << 20} {
+		ra := newReadAhead(&shortReader{Reader: bytes.NewReader(data), rnd: rand.New(rand.NewSource(window))}, 0, window)
+		off := int64(0)
+		for i := 0; i < 2000; i++ {
+			length := 1 + rnd.Intn(40000)
+			switch rnd.Intn(10) {
+			case 0:
+				// Seek anywhere, including past the end.
+				off = rnd.Int63n(int64(len(data)) + 1000)
+			case 1:
+				// A read arriving late.
+				off = max(0, off-rnd.Int63n(3*window/4))
+			}
+			checkReadAt(t, ra, data, off, length)
+			off += int64(length)
+			if off >= int64(len(data)) {
+				off = 0
+			}
+		}
+		if e := ra.Close(); e != nil {
+			t.Errorf("Close: %v", e)
+		}
+	}
+}
+
+func TestReadAheadConcurrent(t *testing.T) {
+	rnd := rand.New(rand.NewSource(2))
+	data := make([]byte, 512*1024)
+	rnd.Read(data)
+	ra := newReadAhead(&shortReader{Reader: bytes.NewReader(data), rnd: rand.New(rand.NewSource(3))}, 0, 64*1024)
+	defer ra.Close()
+	// Pipelined sequential reads executed in any order, like the reads of a client.
+	const chunk = 32 * 1024
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for off := int64(g * chunk); off < int64(len(data))+chunk; off += 4 * chunk {
+				checkReadAt(t, ra, data, off, chunk)
+			}
+		}(g)
+	}
+	wg.Wait()
+}
@@ -2,12 +2,13 @@ package sftpd
 
 import (
 	"fmt"
+	"os"
 	"time"
 )
 
 func readdirLongName(fi *NamedAttr) string {
 	return fmt.Sprintf("%10s %3d %-8s %-8s %8d %12s %s",
-		fi.Mode.String(),
+		lsMode(fi.Mode),
 		1, // links
 		fi.User, fi.Group,
 		fi.Size,
@@ -23,3 +24,41 @@ func readdirTimeFormat(t time.Time) string {
 	}
 	return t.Format("Jan _2  2006")
 }
+
+// lsMode formats a mode like ls -l, os.FileMode.String uses other letters for the file types.
+func lsMode(m os.FileMode) string {
+	b := []byte("-rwxrwxrwx")
+	switch {
+	case m.IsDir():
+		b[0] = 'd'
+	case m&os.ModeSymlink != 0:
+		b[0] = 'l'
+	case m&os.ModeNamedPipe != 0:
+		b[0] = 'p'
+	case m&os.ModeSocket != 0:
+		b[0] = 's'
+	case m&os.ModeCharDevice != 0:
+		b[0] = 'c'
+	case m&os.ModeDevice != 0:
+		b[0] = 'b'
+	case !m.IsRegular():
+		b[0] = '?'
+	}
+	for i := 0; i < 9; i++ {
+		if m&(1<<uint(8-i)) == 0 {
+			b[i+1] = '-'
+		}
+	}
+	special := func(i int, set bool, c byte) {
+		if set {
+			if b[i] == '-' {
+				c -= 'a' - 'A'
+			}
+			b[i] = c
+		}
+	}
+	special(3, m&os.ModeSetuid != 0, 's')
+	special(6, m&os.ModeSetgid != 0, 's')
+	special(9, m&os.ModeSticky != 0, 't')
+	return string(b)
+}
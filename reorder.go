@@ -0,0 +1,229 @@
+package sftpd
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sort"
+)
+
+// errWriteBehind is returned for a write before data already written to a
+// FileTransfer that cannot seek back.
+var errWriteBehind = &StatusError{Code: STATUS_FAILURE, Message: "Write before data already flushed to a stream that cannot seek"}
+
+// errSpillFull is returned for a write ahead of the position of a stream that
+// does not fit in the spill file anymore.
+var errSpillFull = &StatusError{Code: STATUS_FAILURE, Message: "Too much data written ahead of the stream position"}
+
+// errWritesHeld is returned by a Sync while writes are held for a stream that
+// cannot seek to them.
+var errWritesHeld = &StatusError{Code: STATUS_FAILURE, Message: "Writes ahead of the stream position are not written yet"}
+
+// heldWrite is a write that arrived ahead of the position of the writer.
+type heldWrite struct {
+	off int64
+	// data is the data held in memory, nil if spilled.
+	data []byte
+	// spill is the position of the data in the spill file and n its length.
+	spill int64
+	n     int
+}
+
+func (w *heldWrite) end() int64 { return w.off + int64(w.n) }
+
+// slice returns the part of w from offset from to offset to.
+func (w *heldWrite) slice(from, to int64) *heldWrite {
+	r := &heldWrite{off: from, n: int(to - from), spill: w.spill + from - w.off}
+	if w.data != nil {
+		r.data = w.data[from-w.off : to-w.off]
+	}
+	return r
+}
+
+// reorderBuffer holds the writes that arrive ahead of the position of a stream,
+// clients pipeline writes and they may be executed out of order. Up to window
+// bytes are kept in memory, the rest is spilled to a temporary file of at most
+// spillLimit bytes. The held writes do not overlap and are sorted by offset.
+type reorderBuffer struct {
+	window     int
+	spillLimit int64
+	held       []*heldWrite
+	mem        int
+	spill      *os.File
+	// spillEnd is the end of the data written to the spill file.
+	spillEnd int64
+}
+
+// hold keeps a copy of p to be written at off later, replacing the held data
+// it overlaps.
+func (b *reorderBuffer) hold(p []byte, off int64) error {
+	if len(p) == 0 {
+		return nil
+	}
+	hw := &heldWrite{off: off, n: len(p)}
+	b.overwrite(hw.off, hw.end())
+	if b.mem+len(p) <= b.window {
+		hw.data = append([]byte(nil), p...)
+		b.mem += len(p)
+	} else {
+		if b.spillEnd+int64(len(p)) > b.spillLimit {
+			return errSpillFull
+		}
+		if b.spill == nil {
+			f, e := os.CreateTemp("", "sftpd-reorder-*")
+			if e != nil {
+				return e
+			}
+			b.spill = f
+		}
+		_, e := b.spill.WriteAt(p, b.spillEnd)
+		if e != nil {
+			return e
+		}
+		hw.spill = b.spillEnd
+		b.spillEnd += int64(len(p))
+	}
+	i := sort.Search(len(b.held), func(i int) bool { return b.held[i].off >= off })
+	b.held = append(b.held, nil)
+	copy(b.held[i+1:], b.held[i:])
+	b.held[i] = hw
+	return nil
+}
+
+// overwrite drops the held data from offset from to offset to, a later write
+// replaces it. The held writes it partly overlaps are cut to the rest.
+func (b *reorderBuffer) overwrite(from, to int64) {
+	var kept, dropped []*heldWrite
+	for _, o := range b.held {
+		if o.end() <= from || o.off >= to {
+			kept = append(kept, o)
+			continue
+		}
+		var parts []*heldWrite
+		if o.off < from {
+			parts = append(parts, o.slice(o.off, from))
+		}
+		if o.end() > to {
+			parts = append(parts, o.slice(to, o.end()))
+		}
+		for _, part := range parts {
+			if part.data != nil {
+				b.mem += part.n
+			}
+		}
+		kept = append(kept, parts...)
+		dropped = append(dropped, o)
+	}
+	if dropped == nil {
+		return
+	}
+	b.held = kept
+	for _, o := range dropped {
+		b.release(o)
+	}
+}
+
+// next removes and returns the held write with the lowest offset, nil if none is held.
+func (b *reorderBuffer) next() (*heldWrite, []byte, error) {
+	if len(b.held) == 0 {
+		return nil, nil, nil
+	}
+	hw := b.held[0]
+	b.held = b.held[1:]
+	data := hw.data
+	if data == nil {
+		data = make([]byte, hw.n)
+		_, e := b.spill.ReadAt(data, hw.spill)
+		if e != nil {
+			return nil, nil, e
+		}
+	}
+	b.release(hw)
+	return hw, data, nil
+}
+
+// release accounts for a held write leaving the buffer. The spill file is
+// emptied once no spilled write is held anymore.
+func (b *reorderBuffer) release(hw *heldWrite) {
+	if hw.data != nil {
+		b.mem -= hw.n
+	}
+	if b.spill == nil || b.spillEnd == 0 {
+		return
+	}
+	for _, o := range b.held {
+		if o.data == nil && o != hw {
+			return
+		}
+	}
+	if b.spill.Truncate(0) == nil {
+		b.spillEnd = 0
+	}
+}
+
+// first returns the offset of the lowest held write, ok is false if none is held.
+func (b *reorderBuffer) first() (off int64, ok bool) {
+	if len(b.held) == 0 {
+		return 0, false
+	}
+	return b.held[0].off, true
+}
+
+// discard drops the held writes and removes the spill file.
+func (b *reorderBuffer) discard() error {
+	b.held = nil
+	b.mem = 0
+	if b.spill == nil {
+		return nil
+	}
+	name := b.spill.Name()
+	e := b.spill.Close()
+	b.spill = nil
+	b.spillEnd = 0
+	return errors.Join(e, os.Remove(name))
+}
+
+// drain writes the held writes that start at or before the position of a,
+// the parts already overwritten by later writes are skipped.
+func (a *AutoSeekWriter) drain() error {
+	for {
+		off, ok := a.buf.first()
+		if !ok || off > a.cur {
+			return nil
+		}
+		e := a.writeHeld()
+		if e != nil {
+			return e
+		}
+	}
+}
+
+// writeHeld writes the part of the lowest held write after the position of a,
+// seeking forward to it if needed.
+func (a *AutoSeekWriter) writeHeld() error {
+	hw, data, e := a.buf.next()
+	if e != nil || hw == nil || hw.end() <= a.cur {
+		return e
+	}
+	if hw.off > a.cur {
+		o, e := a.w.Seek(hw.off, io.SeekStart)
+		if e != nil {
+			return e
+		}
+		a.cur = o
+	}
+	n, e := a.w.Write(data[a.cur-hw.off:])
+	a.cur += int64(n)
+	return e
+}
+
+// flush writes all the held writes, seeking over the gaps between them.
+func (a *AutoSeekWriter) flush() error {
+	for len(a.buf.held) > 0 {
+		e := a.writeHeld()
+		if e != nil {
+			return e
+		}
+	}
+	return nil
+}
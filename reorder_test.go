@@ -0,0 +1,72 @@
+package sftpd
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+// streamWriter is a WriteSeekCloser that cannot seek except to its position.
+type streamWriter struct {
+	bytes.Buffer
+}
+
+func (s *streamWriter) Seek(off int64, whence int) (int64, error) {
+	if whence != io.SeekStart || off != int64(s.Len()) {
+		return 0, errors.New("cannot seek")
+	}
+	return off, nil
+}
+
+func (s *streamWriter) Close() error { return nil }
+
+func newStreamWriter(window int, spillLimit int64) (*AutoSeekWriter, *streamWriter) {
+	s := &streamWriter{}
+	a := &AutoSeekWriter{w: s}
+	a.buf.window = window
+	a.buf.spillLimit = spillLimit
+	return a, s
+}
+
+func TestReorderOverlappingWrites(t *testing.T) {
+	for _, window := range []int{1024, 8} {
+		a, s := newStreamWriter(window, 1024)
+		writes := []struct {
+			off  int64
+			data string
+		}{
+			{15, "BBBBBBBBBBBBBBBBBBBB"},
+			{20, "yy"},
+			{10, "cccccccc"},
+			{30, "dddddddddd"},
+			{0, "AAAAAAAAAAAAAAA"},
+		}
+		for _, w := range writes {
+			if _, e := a.WriteAt([]byte(w.data), w.off); e != nil {
+				t.Fatalf("window %d: WriteAt(%q, %d): %v", window, w.data, w.off, e)
+			}
+		}
+		if e := a.Close(); e != nil {
+			t.Fatalf("window %d: Close: %v", window, e)
+		}
+		want := "AAAAAAAAAAAAAAAcccBByyBBBBBBBBdddddddddd"
+		if got := s.String(); got != want {
+			t.Errorf("window %d: got %q, want %q", window, got, want)
+		}
+	}
+}
+
+func TestReorderSpillLimit(t *testing.T) {
+	a, _ := newStreamWriter(4, 8)
+	defer a.Abort()
+	if _, e := a.WriteAt([]byte("0123"), 10); e != nil {
+		t.Fatalf("held write: %v", e)
+	}
+	if _, e := a.WriteAt([]byte("01234567"), 20); e != nil {
+		t.Fatalf("spilled write: %v", e)
+	}
+	if _, e := a.WriteAt([]byte("x"), 30); e != errSpillFull {
+		t.Errorf("write past the spill limit: got %v, want %v", e, errSpillFull)
+	}
+}
@@ -6,8 +6,8 @@ import (
 	"encoding/binary"
 	"errors"
 	"io"
-	"os"
-	"time"
+	"path"
+	"sync"
 
 	"github.com/OpenListTeam/sftpd-openlist/binp"
 	"github.com/taruti/bytepool"
@@ -21,365 +21,829 @@ func IsSftpRequest(req *ssh.Request) bool {
 	return req.Type == "subsystem" && bytes.Equal(sftpSubSystem, req.Payload)
 }
 
-var initReply = []byte{0, 0, 0, 5, ssh_FXP_VERSION, 0, 0, 0, 3}
-
 type DebugLogger func(s string, v ...interface{})
 
+// ServeOptions tunes how a channel is served. The zero value gives the defaults.
+type ServeOptions struct {
+	// SymlinkSpecOrder makes SSH_FXP_SYMLINK take its arguments in the order of
+	// the SFTP drafts, linkpath before targetpath. OpenSSH and most clients
+	// derived from it send them the other way around, which is the default.
+	SymlinkSpecOrder bool
+	// MaxPacketLength is the largest packet accepted from the client, 64 KiB if zero.
+	// Smaller values than the 34000 bytes every SFTP implementation must accept are
+	// raised to it.
+	MaxPacketLength uint32
+	// MaxReadLength caps the data returned by a single read, 64 KiB if zero.
+	MaxReadLength uint32
+	// MaxWriteLength is the largest write accepted, MaxPacketLength minus
+	// room for the request header if zero or larger.
+	MaxWriteLength uint32
+	// MaxOpenHandles limits the file and directory handles open at the same time, 256 if zero.
+	MaxOpenHandles uint32
+	// MaxOpenDirs limits the directory handles open at the same time, 64 if zero.
+	MaxOpenDirs uint32
+	// LazyOpen defers opening files on the FileSystem from SSH_FXP_OPEN to the
+	// first read or write of the handle. Errors are then reported by that request
+	// and files opened for writing but never written are not created.
+	LazyOpen bool
+	// MaxConcurrentRequests is the number of requests of a session executed at
+	// the same time, 16 if zero. Requests on the same handle or path, including
+	// the handles open on that path, are executed in the order they were received,
+	// the requests waiting for the previous ones do not count.
+	MaxConcurrentRequests uint32
+	// DeferSetStat queues SSH_FXP_SETSTAT and SSH_FXP_FSETSTAT attributes other
+	// than the size for files with an open write handle and sets them after the
+	// handle is closed, for FileSystems that commit uploads on Close. Failures
+	// are reported by the SSH_FXP_CLOSE.
+	DeferSetStat bool
+	// Extensions is the registry of the SSH_FXP_EXTENDED handlers served in
+	// addition to the ones built into this package, DefaultExtensions if nil.
+	Extensions *Extensions
+	// MaxVersion is the highest SFTP version negotiated with clients, from 3 to 6.
+	// Sessions use the version requested by the client up to MaxVersion, 6 if zero.
+	MaxVersion uint32
+	// WriteReorderWindow is the memory used by an upload to hold the writes executed
+	// ahead of its position, 1 MiB if zero. Clients pipeline writes which may then
+	// arrive out of order, holding them lets FileTransfers that cannot seek accept
+	// them. Writes beyond the window are kept in a temporary file. FileTransfers
+	// that can seek are seeked to the writes instead.
+	WriteReorderWindow uint32
+	// MaxReorderSpill limits the held writes of an upload kept in the temporary
+	// file, 64 MiB if zero. Writes are failed once it is full.
+	MaxReorderSpill uint32
+	// ReadAhead is the data prefetched in the background for each download handle,
+	// disabled if zero. Reads within the prefetched data are served from memory,
+	// other reads seek the FileSystem and restart the prefetching there. Handles
+	// opened for reading and writing and the handles of FileSystems implementing
+	// FileSystemExtensionRangeReader are not prefetched.
+	ReadAhead uint32
+
+	// errorLog logs the errors that cannot be reported to the client, like closing
+	// the handles still open when the session ends. SftpServer sets it to log with
+	// Config.ErrorLogFunc, they are only passed to the DebugLogger otherwise.
+	errorLog func(v ...interface{})
+}
+
+const (
+	defaultMaxPacketLength = 64 * 1024
+	defaultMaxReadLength   = 64 * 1024
+	defaultMaxOpenHandles  = 0x100
+	defaultMaxOpenDirs     = 64
+	defaultMaxConcurrency  = 16
+	defaultReorderWindow   = 1024 * 1024
+	defaultReorderSpill    = 64 * 1024 * 1024
+	minVersion             = 3
+	maxVersion             = 6
+	// maxQueuedRequests is the number of requests of a session read before
+	// the previous ones are done, including the ones executed.
+	maxQueuedRequests = 256
+	// minPacketLength is the packet length the SFTP drafts require servers to accept.
+	minPacketLength = 34000
+	// writeHeaderRoom is the room left for the request header of a write
+	// when deriving MaxWriteLength from MaxPacketLength.
+	writeHeaderRoom = 1024
+)
+
+// withDefaults returns a copy of o with the zero limits replaced by their defaults.
+func (o *ServeOptions) withDefaults() *ServeOptions {
+	r := &ServeOptions{}
+	if o != nil {
+		*r = *o
+	}
+	if r.MaxPacketLength == 0 {
+		r.MaxPacketLength = defaultMaxPacketLength
+	}
+	if r.MaxPacketLength < minPacketLength {
+		r.MaxPacketLength = minPacketLength
+	}
+	if r.MaxReadLength == 0 {
+		r.MaxReadLength = defaultMaxReadLength
+	}
+	if r.MaxWriteLength == 0 || r.MaxWriteLength > r.MaxPacketLength-writeHeaderRoom {
+		r.MaxWriteLength = r.MaxPacketLength - writeHeaderRoom
+	}
+	if r.MaxOpenHandles == 0 {
+		r.MaxOpenHandles = defaultMaxOpenHandles
+	}
+	if r.MaxOpenDirs == 0 {
+		r.MaxOpenDirs = defaultMaxOpenDirs
+	}
+	if r.MaxConcurrentRequests == 0 {
+		r.MaxConcurrentRequests = defaultMaxConcurrency
+	}
+	if r.WriteReorderWindow == 0 {
+		r.WriteReorderWindow = defaultReorderWindow
+	}
+	if r.MaxReorderSpill == 0 {
+		r.MaxReorderSpill = defaultReorderSpill
+	}
+	if r.Extensions == nil {
+		r.Extensions = DefaultExtensions
+	}
+	if r.MaxVersion == 0 || r.MaxVersion > maxVersion {
+		r.MaxVersion = maxVersion
+	}
+	if r.MaxVersion < minVersion {
+		r.MaxVersion = minVersion
+	}
+	return r
+}
+
 // ServeChannel serves a ssh.Channel with the given FileSystem.
 func ServeChannel(c ssh.Channel, fs FileSystem, debugf DebugLogger) error {
+	return ServeChannelWithOptions(c, fs, nil, debugf)
+}
+
+// ServeChannelWithOptions serves a ssh.Channel with the given FileSystem and options.
+// A nil opts is the same as the zero ServeOptions.
+func ServeChannelWithOptions(c ssh.Channel, fs FileSystem, opts *ServeOptions, debugf DebugLogger) error {
 	defer func() { _ = c.Close() }()
-	var h handles
-	h.init()
-	brd := bufio.NewReaderSize(c, 64*1024)
+	s, e := newSession(c, fs, opts, debugf)
+	if e != nil {
+		return e
+	}
+	return s.serve(c)
+}
+
+// session is the state of a served channel shared by the concurrently executed requests.
+type session struct {
+	w      *channelWriter
+	fs     FileSystem
+	opts   *ServeOptions
+	home   homeDir
+	h      handles
+	debugf DebugLogger
+	// version is the negotiated protocol version, it is set by SSH_FXP_INIT
+	// before any other request is executed.
+	version uint32
+
+	c     io.Closer
+	errMu sync.Mutex
+	err   error
+}
+
+// newSession fails if the home directory of the user cannot be looked up, the
+// relative paths of the session could not be resolved.
+func newSession(c ssh.Channel, fs FileSystem, opts *ServeOptions, debugf DebugLogger) (*session, error) {
+	s := &session{w: &channelWriter{w: c}, fs: fs, opts: opts.withDefaults(), debugf: debugf, c: c, version: minVersion}
 	var e error
-	var plen int
-	var op byte
-	var bs []byte
-	var id uint32
+	s.home, e = sessionHome(fs)
+	if e != nil {
+		debugf("Home directory lookup failed: %v\n", e)
+		return nil, e
+	}
+	s.h.init(s.opts)
+	return s, nil
+}
+
+// serve reads requests and executes them on a bounded pool of workers. Requests on
+// the same handle or path wait for the previous one to finish, so their order is kept.
+// Waiting requests do not hold a worker, up to maxQueuedRequests are read ahead.
+func (s *session) serve(rd io.Reader) error {
+	brd := bufio.NewReaderSize(rd, 64*1024)
+	workers := make(chan struct{}, s.opts.MaxConcurrentRequests)
+	queued := make(chan struct{}, max(maxQueuedRequests, s.opts.MaxConcurrentRequests))
+	var wg sync.WaitGroup
+	// The handles are closed once the running requests are done with them.
+	defer s.closeHandles()
+	defer wg.Wait()
+	var lanes lanes
+	started := false
 	for {
+		op, bs, e := s.readPacket(brd)
 		if e != nil {
-			debugf("Sending error: %v\n", e)
-			e = writeErr(c, id, e, debugf)
+			return s.fatal(e)
+		}
+		if op == ssh_FXP_INIT {
+			// The version cannot change once requests are executed.
+			if !started {
+				e = s.init(bs)
+			} else {
+				s.debugf("Ignoring repeated INIT\n")
+			}
+			started = true
+			bytepool.Free(bs)
 			if e != nil {
-				return e
+				return s.fatal(e)
 			}
+			continue
 		}
-		_ = discard(brd, plen)
-		plen, op, e = readPacketHeader(brd)
+		started = true
+		keys := s.laneKeys(op, bs)
+		prev, done := lanes.enter(keys)
+		queued <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, p := range prev {
+				<-p
+			}
+			workers <- struct{}{}
+			e := s.handle(op, bs)
+			<-workers
+			bytepool.Free(bs)
+			lanes.leave(keys, done)
+			<-queued
+			if e != nil {
+				s.fail(e)
+			}
+		}()
+	}
+}
+
+// readPacket reads the next request, the returned data is allocated from bytepool.
+// Packets with a valid length that cannot be served are skipped.
+func (s *session) readPacket(brd *bufio.Reader) (byte, []byte, error) {
+	for {
+		plen, op, e := readPacketHeader(brd)
 		if e != nil {
-			return e
+			return 0, nil, e
 		}
 		plen--
-		debugf("CR op=%v data len=%d\n", ssh_fxp(op), plen)
-		if plen < 2 {
-			return errors.New("Packet too short")
+		s.debugf("CR op=%v data len=%d\n", ssh_fxp(op), plen)
+		if plen < 0 {
+			return 0, nil, errors.New("Packet too short")
 		}
-		// Feeding too large values to peek is ok, it just errors.
-		bs, e = brd.Peek(plen)
-		if e != nil {
-			return e
-		}
-		debugf("Data %X\n", bs)
-		p := binp.NewParser(bs)
-		switch op {
-		case ssh_FXP_INIT:
-			debugf("Init %v\n", initReply)
-			e = wrc(c, initReply)
-		case ssh_FXP_OPEN:
-			var path string
-			var flags uint32
-			var a Attr
-			e = parseAttr(p.B32(&id).B32String(&path).B32(&flags), &a).End()
+		if plen < 4 || plen >= int(s.opts.MaxPacketLength) {
+			e = s.skipPacket(brd, plen)
 			if e != nil {
-				return e
-			}
-			debugf("Open id=%v path=%s flags=%v\n", id, path, flags)
-			if h.nfiles() >= maxFiles {
-				e = errTooManyFiles
-				continue
-			}
-			handle := h.newFile(&FileOpenArgs{path, flags, &a})
-			debugf("Open ret: handle=%s\n", handle)
-			e = writeHandle(c, id, handle)
-		case ssh_FXP_CLOSE:
-			var handle string
-			e = p.B32(&id).B32String(&handle).End()
-			if e != nil {
-				return e
-			}
-			debugf("Close id=%v handle=%s\n", id, handle)
-			h.closeHandle(handle)
-			e = writeErr(c, id, nil, debugf)
-		case ssh_FXP_READ:
-			var handle string
-			var offset uint64
-			var length uint32
-			var n int
-			e = p.B32(&id).B32String(&handle).B64(&offset).B32(&length).End()
-			if e != nil {
-				return e
-			}
-			debugf("Read id=%v handle=%s offset=%v length=%v\n", id, handle, offset, length)
-			f := h.getFile(handle)
-			if f == nil {
-				return errInvalidHandle
-			}
-			if length > 64*1024 {
-				length = 64 * 1024
-			}
-			bs := bytepool.Alloc(int(length))
-			if reader, ok := h.fr[handle]; ok {
-				n, e = reader.ReadAt(bs, int64(offset))
-			} else {
-				if ft, ok := fs.(FileSystemExtentionFileTransfer); ok {
-					var t FileTransfer
-					t, e = ft.GetHandle(f.name, f.flags, f.attr, offset)
-					if e == nil {
-						br := &BufferedReader{r: t, cur: int64(offset)}
-						n, e = br.ReadAt(bs, int64(offset))
-						h.fr[handle] = br
-					}
-				} else {
-					var file File
-					file, e = fs.OpenFile(f.name, f.flags, f.attr)
-					if e == nil {
-						if offset != 0 {
-							_, e = file.Seek(int64(offset), io.SeekStart)
-						}
-						if e == nil {
-							br := &BufferedReader{r: file, cur: int64(offset)}
-							n, e = br.ReadAt(bs, int64(offset))
-							h.fr[handle] = br
-						}
-					}
-				}
-			}
-			// Handle go readers that return io.EOF and bytes at the same time.
-			if e == io.EOF && n > 0 {
-				debugf("Read EOF, n=%d\n", n)
-				e = nil
-			}
-			if e != nil {
-				bytepool.Free(bs)
-				continue
-			}
-			bs = bs[0:n]
-			e = wrc(c, binp.Out().B32(1+4+4+uint32(len(bs))).Byte(ssh_FXP_DATA).B32(id).B32(uint32(len(bs))).Out())
-			if e == nil {
-				e = wrc(c, bs)
+				return 0, nil, e
 			}
+			continue
+		}
+		bs := bytepool.Alloc(plen)
+		_, e = io.ReadFull(brd, bs)
+		if e != nil {
 			bytepool.Free(bs)
-		case ssh_FXP_WRITE:
-			var handle string
-			var offset uint64
-			var length uint32
-			p.B32(&id).B32String(&handle).B64(&offset).B32(&length)
-			debugf("Write id=%v handle=%s offset=%v length=%v\n", id, handle, offset, length)
-			f := h.getFile(handle)
-			if f == nil {
-				return errInvalidHandle
+			return 0, nil, e
+		}
+		s.debugf("Data %X\n", bs)
+		return op, bs, nil
+	}
+}
+
+// skipPacket discards a packet too short to contain a request id or too long
+// to be read, the latter is answered with a SSH_FX_BAD_MESSAGE status.
+func (s *session) skipPacket(brd *bufio.Reader, plen int) error {
+	if plen < 4 {
+		s.debugf("Skipping packet without request id\n")
+		_, e := brd.Discard(plen)
+		return e
+	}
+	var idbs [4]byte
+	_, e := io.ReadFull(brd, idbs[:])
+	if e != nil {
+		return e
+	}
+	_, e = io.CopyN(io.Discard, brd, int64(plen-4))
+	if e != nil {
+		return e
+	}
+	return writeStatus(s.w, s.version, binary.BigEndian.Uint32(idbs[:]), STATUS_BAD_MESSAGE, "Packet too long", s.debugf)
+}
+
+// lanes maps a handle or path to the completion of the last request using it.
+// A request waits for the previous requests sharing one of its keys.
+type lanes struct {
+	mu sync.Mutex
+	m  map[string]chan struct{}
+}
+
+// enter registers a request using keys and returns the completions to wait for
+// and the one to close when it is done.
+func (l *lanes) enter(keys []string) ([]chan struct{}, chan struct{}) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	done := make(chan struct{})
+	var prev []chan struct{}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.m == nil {
+		l.m = map[string]chan struct{}{}
+	}
+	for _, k := range keys {
+		if p := l.m[k]; p != nil && p != done {
+			prev = append(prev, p)
+		}
+		l.m[k] = done
+	}
+	return prev, done
+}
+
+// leave completes a request, the keys no later request waits on are removed.
+func (l *lanes) leave(keys []string, done chan struct{}) {
+	if done == nil {
+		return
+	}
+	close(done)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, k := range keys {
+		if l.m[k] == done {
+			delete(l.m, k)
+		}
+	}
+}
+
+// laneKeys returns the keys ordering a request: the path of the handle it operates
+// on, or the handle if it is not open, and the paths it refers to. Requests on a
+// handle are thereby also ordered with the path requests on its file.
+func (s *session) laneKeys(op byte, bs []byte) []string {
+	var id uint32
+	var k, p1, p2 string
+	p := binp.NewParser(bs).B32(&id)
+	switch op {
+	case ssh_FXP_CLOSE, ssh_FXP_READ, ssh_FXP_WRITE, ssh_FXP_FSTAT, ssh_FXP_FSETSTAT, ssh_FXP_READDIR:
+		p.B32String(&k)
+	case ssh_FXP_OPEN, ssh_FXP_OPENDIR, ssh_FXP_REMOVE, ssh_FXP_MKDIR, ssh_FXP_RMDIR,
+		ssh_FXP_STAT, ssh_FXP_LSTAT, ssh_FXP_SETSTAT, ssh_FXP_READLINK:
+		p.B32String(&p1)
+	case ssh_FXP_RENAME, ssh_FXP_SYMLINK, ssh_FXP_LINK:
+		p.B32String(&p1).B32String(&p2)
+	case ssh_FXP_EXTENDED:
+		var name string
+		var data []byte
+		if p.B32String(&name).PeekRest(&data) == nil {
+			return nil
+		}
+		ext := s.opts.Extensions.lookup(name)
+		if ext == nil {
+			return nil
+		}
+		if ext.lane != nil {
+			k = ext.lane(data)
+		}
+		if ext.paths != nil {
+			var keys []string
+			for _, pth := range ext.paths(data) {
+				keys = append(keys, s.pathKey(pth))
 			}
-			var bs []byte
-			e = p.BytesPeek(int(length), &bs).End()
+			return append(keys, s.handleKeys(k)...)
+		}
+	}
+	keys := s.handleKeys(k)
+	for _, pth := range []string{p1, p2} {
+		if pth != "" {
+			keys = append(keys, s.pathKey(pth))
+		}
+	}
+	return keys
+}
+
+// handleKeys returns the lane key of a handle, none if k is empty.
+func (s *session) handleKeys(k string) []string {
+	if k == "" {
+		return nil
+	}
+	if name, ok := s.h.getName(k); ok {
+		return []string{"p" + path.Clean(name)}
+	}
+	return []string{"h" + k}
+}
+
+// pathKey returns the lane key of a path sent by the client.
+func (s *session) pathKey(p string) string {
+	return "p" + path.Clean(s.home.abs(p))
+}
+
+// fail records a fatal error of a worker and closes the channel to stop serve.
+func (s *session) fail(e error) {
+	s.errMu.Lock()
+	defer s.errMu.Unlock()
+	if s.err == nil {
+		s.debugf("Fatal error: %v\n", e)
+		s.err = e
+		_ = s.c.Close()
+	}
+}
+
+// closeHandles closes the handles the client left open, uploads are aborted.
+func (s *session) closeHandles() {
+	s.h.abortAll(func(name string, e error) {
+		s.debugf("Closing %s at session end failed: %v\n", name, e)
+		if s.opts.errorLog != nil {
+			s.opts.errorLog("sftpd closing handle failed:", name, e)
+		}
+	})
+}
+
+// fatal returns the error ending the session, preferring the one of a failed worker
+// over the read error it caused.
+func (s *session) fatal(e error) error {
+	s.errMu.Lock()
+	defer s.errMu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	return e
+}
+
+// init negotiates the protocol version with the version requested by the client.
+func (s *session) init(bs []byte) error {
+	var version uint32
+	// The version may be followed by extension data, which is ignored.
+	binp.NewParser(bs).B32(&version)
+	s.version = max(minVersion, min(version, s.opts.MaxVersion))
+	reply := versionReply(s.version, s.fs, s.opts.Extensions)
+	s.debugf("Init client=%d version=%d %v\n", version, s.version, reply)
+	return wrc(s.w, reply)
+}
+
+// handle executes a request. Errors of the operation, malformed requests and
+// invalid handles are answered with a status, only errors writing to the
+// channel are returned.
+func (s *session) handle(op byte, bs []byte) error {
+	fs, h, opts, home, debugf := s.fs, &s.h, s.opts, s.home, s.debugf
+	c, v := s.w, s.version
+	var id uint32
+	var e error
+	p := binp.NewParser(bs)
+	switch op {
+	case ssh_FXP_OPEN:
+		var path string
+		var access, flags uint32
+		var a Attr
+		p = p.B32(&id).B32String(&path)
+		if v >= 5 {
+			p = p.B32(&access)
+		}
+		e = parseAttr(p.B32(&flags), &a, v).End()
+		if e != nil {
+			return writeErr(c, v, id, e, debugf)
+		}
+		if v >= 5 {
+			flags = openFlagsV5(access, flags)
+		}
+		path = home.abs(path)
+		debugf("Open id=%v path=%s flags=%v\n", id, path, flags)
+		e = checkOpen(fs, path, OpenFlags(flags))
+		if e != nil {
+			return writeErr(c, v, id, e, debugf)
+		}
+		handle, e := h.newFile(&FileOpenArgs{name: path, flags: flags, attr: &a}, int(opts.MaxOpenHandles))
+		if e != nil {
+			return writeErr(c, v, id, e, debugf)
+		}
+		if !opts.LazyOpen {
+			e = h.openEager(fs, handle)
 			if e != nil {
-				return e
+				_ = h.closeHandle(fs, handle)
+				return writeErr(c, v, id, e, debugf)
 			}
-			if writer, ok := h.fw[handle]; ok {
-				_, e = writer.WriteAt(bs, int64(offset))
-			} else {
-				if ft, ok := fs.(FileSystemExtentionFileTransfer); ok {
-					var t FileTransfer
-					t, e = ft.GetHandle(f.name, f.flags, f.attr, offset)
-					if e == nil {
-						aw := &AutoSeekWriter{w: t, cur: int64(offset)}
-						_, e = aw.WriteAt(bs, int64(offset))
-						h.fw[handle] = aw
-					}
-				} else {
-					var file File
-					file, e = fs.OpenFile(f.name, f.flags, f.attr)
-					if e == nil {
-						if offset != 0 {
-							_, e = file.Seek(int64(offset), io.SeekStart)
-						}
-						if e == nil {
-							aw := &AutoSeekWriter{w: file, cur: int64(offset)}
-							_, e = aw.WriteAt(bs, int64(offset))
-							h.fw[handle] = aw
-						}
-					}
+		}
+		debugf("Open ret: handle=%s\n", handle)
+		return writeHandle(c, id, handle)
+	case ssh_FXP_CLOSE:
+		var handle string
+		e = p.B32(&id).B32String(&handle).End()
+		if e != nil {
+			return writeErr(c, v, id, e, debugf)
+		}
+		debugf("Close id=%v handle=%s\n", id, handle)
+		e = h.closeHandle(fs, handle)
+		if e == errInvalidHandle {
+			return writeErr(c, v, id, e, debugf)
+		}
+		if e != nil {
+			debugf("Close failed: %v\n", e)
+			code, msg := errorStatus(e)
+			return writeStatus(c, v, id, code, "Close failed: "+msg, debugf)
+		}
+		return writeErr(c, v, id, nil, debugf)
+	case ssh_FXP_READ:
+		var handle string
+		var offset uint64
+		var length uint32
+		var n int
+		e = p.B32(&id).B32String(&handle).B64(&offset).B32(&length).End()
+		if e != nil {
+			return writeErr(c, v, id, e, debugf)
+		}
+		debugf("Read id=%v handle=%s offset=%v length=%v\n", id, handle, offset, length)
+		if h.getFile(handle) == nil {
+			return writeErr(c, v, id, errInvalidHandle, debugf)
+		}
+		if length > opts.MaxReadLength {
+			length = opts.MaxReadLength
+		}
+		// The reply header is written in front of the data to send the packet at once.
+		const hlen = 4 + 1 + 4 + 4
+		bs := bytepool.Alloc(hlen + int(length))
+		defer bytepool.Free(bs)
+		var reader ReadAtCloser
+		reader, e = h.reader(fs, handle, offset)
+		if e == nil {
+			n, e = reader.ReadAt(bs[hlen:], int64(offset))
+		}
+		// Handle go readers that return io.EOF and bytes at the same time.
+		if e == io.EOF && n > 0 {
+			debugf("Read EOF, n=%d\n", n)
+			e = nil
+		}
+		if e != nil {
+			return writeErr(c, v, id, e, debugf)
+		}
+		binp.OutWith(bs[:0]).B32(1 + 4 + 4 + uint32(n)).Byte(ssh_FXP_DATA).B32(id).B32(uint32(n))
+		return wrc(c, bs[:hlen+n])
+	case ssh_FXP_WRITE:
+		var handle string
+		var offset uint64
+		var length uint32
+		var bs []byte
+		p = p.B32(&id).B32String(&handle).B64(&offset).B32(&length)
+		e = p.BytesPeek(int(length), &bs).End()
+		if e != nil {
+			return writeErr(c, v, id, e, debugf)
+		}
+		debugf("Write id=%v handle=%s offset=%v length=%v\n", id, handle, offset, length)
+		if h.getFile(handle) == nil {
+			return writeErr(c, v, id, errInvalidHandle, debugf)
+		}
+		if length > opts.MaxWriteLength {
+			return writeErr(c, v, id, errWriteTooLong, debugf)
+		}
+		var writer WriteAtCloser
+		writer, e = h.writer(fs, handle, offset)
+		if e == nil {
+			_, e = writer.WriteAt(bs, int64(offset))
+			h.markWritten(handle)
+		}
+		return writeErr(c, v, id, e, debugf)
+	case ssh_FXP_LSTAT, ssh_FXP_STAT:
+		var path string
+		var a *Attr
+		e = skipAttrFlags(p.B32(&id).B32String(&path), v).End()
+		if e != nil {
+			return writeErr(c, v, id, e, debugf)
+		}
+		path = home.abs(path)
+		debugf("Stat/Lstat id=%d path=%s\n", id, path)
+		a, e = fs.Stat(path, op == ssh_FXP_LSTAT)
+		debugf("Stat/Lstat ret: %v %v\n", a, e)
+		return writeAttr(c, v, id, a, e, debugf)
+	case ssh_FXP_FSTAT:
+		var handle string
+		var a *Attr
+		e = skipAttrFlags(p.B32(&id).B32String(&handle), v).End()
+		if e != nil {
+			return writeErr(c, v, id, e, debugf)
+		}
+		debugf("Fstat id=%d handle=%s\n", id, handle)
+		a, e = h.fstat(fs, handle)
+		debugf("Fstat ret: %v %v\n", a, e)
+		return writeAttr(c, v, id, a, e, debugf)
+	case ssh_FXP_SETSTAT:
+		var path string
+		var a Attr
+		e = parseAttr(p.B32(&id).B32String(&path), &a, v).End()
+		if e != nil {
+			return writeErr(c, v, id, e, debugf)
+		}
+		path = home.abs(path)
+		debugf("SetStat id=%d path=%s\n", id, path)
+		if opts.DeferSetStat {
+			if now := h.deferSetStat("", path, &a); now != nil {
+				debugf("SetStat deferred until close\n")
+				if now.Flags == 0 {
+					return writeErr(c, v, id, nil, debugf)
 				}
+				a = *now
 			}
-			e = writeErr(c, id, e, debugf)
-		case ssh_FXP_LSTAT, ssh_FXP_STAT:
-			var path string
-			var a *Attr
-			e = p.B32(&id).B32String(&path).End()
-			if e != nil {
-				return e
-			}
-			debugf("Stat/Lstat id=%d path=%s\n", id, path)
-			a, e = fs.Stat(path, op == ssh_FXP_LSTAT)
-			debugf("Stat/Lstat ret: %v %v\n", a, e)
-			e = writeAttr(c, id, a, e, debugf)
-		case ssh_FXP_FSTAT:
-			var handle string
-			var a *Attr
-			e = p.B32(&id).B32String(&handle).End()
-			if e != nil {
-				return e
-			}
-			debugf("Fstat id=%d handle=%s\n", id, handle)
-			f := h.getFile(handle)
-			if f == nil {
-				return errInvalidHandle
-			}
-			a, e = fs.Stat(f.name, false)
-			debugf("Fstat ret: %v %v\n", a, e)
-			e = writeAttr(c, id, a, e, debugf)
-		case ssh_FXP_SETSTAT:
-			var path string
-			var a Attr
-			e = parseAttr(p.B32(&id).B32String(&path), &a).End()
-			if e != nil {
-				return e
-			}
-			debugf("SetStat id=%d path=%s\n", id, path)
-			e = writeErr(c, id, fs.SetStat(path, &a), debugf)
-		case ssh_FXP_FSETSTAT:
-			var handle string
-			var a Attr
-			e = parseAttr(p.B32(&id).B32String(&handle), &a).End()
-			if e != nil {
-				return e
-			}
-			debugf("FSetStat id=%d handle=%s\n", id, handle)
-			f := h.getFile(handle)
-			if f == nil {
-				return errInvalidHandle
-			}
-			e = writeErr(c, id, fs.SetStat(f.name, &a), debugf)
-		case ssh_FXP_OPENDIR:
-			var path string
-			e = p.B32(&id).B32String(&path).End()
-			if e != nil {
-				return e
-			}
-			debugf("Opendir id=%d path=%s\n", id, path)
-			if e != nil {
-				continue
-			}
-			handle := h.newDir(path)
-			debugf("Opendir ret: handle=%s\n", handle)
-			e = writeHandle(c, id, handle)
-		case ssh_FXP_READDIR:
-			var handle string
-			e = p.B32(&id).B32String(&handle).End()
-			if e != nil {
-				return e
-			}
-			debugf("Readdir id=%d handle=%s\n", id, handle)
-			f := h.getDir(handle)
-			if f == "" {
-				return errInvalidHandle
-			}
-			var fis []NamedAttr
-			if dr, ok := h.dr[handle]; ok {
-				fis, e = dr.Readdir(1024)
-			} else {
-				if frd, ok := fs.(FileSystemExtensionFileList); ok {
-					var allFis []NamedAttr
-					allFis, e = frd.ReadDir(f)
-					if e == nil {
-						dirReader := &DirReader{
-							attrs: allFis,
-							pos:   0,
-						}
-						h.dr[handle] = dirReader
-						fis, e = dirReader.Readdir(1024)
-					}
-				} else {
-					var dir Dir
-					dir, e = fs.OpenDir(f)
-					if e == nil {
-						h.dr[handle] = dir
-						fis, e = dir.Readdir(1024)
-					}
+		}
+		return writeErr(c, v, id, fs.SetStat(path, &a), debugf)
+	case ssh_FXP_FSETSTAT:
+		var handle string
+		var a Attr
+		e = parseAttr(p.B32(&id).B32String(&handle), &a, v).End()
+		if e != nil {
+			return writeErr(c, v, id, e, debugf)
+		}
+		debugf("FSetStat id=%d handle=%s\n", id, handle)
+		if opts.DeferSetStat {
+			if now := h.deferSetStat(handle, "", &a); now != nil {
+				debugf("FSetStat deferred until close\n")
+				if now.Flags == 0 {
+					return writeErr(c, v, id, nil, debugf)
 				}
+				a = *now
 			}
-			debugf("Readdir ret: %v => %v\n", fis, e)
-			if e != nil {
-				continue
+		}
+		return writeErr(c, v, id, h.fsetstat(fs, handle, &a), debugf)
+	case ssh_FXP_OPENDIR:
+		var path string
+		e = p.B32(&id).B32String(&path).End()
+		if e != nil {
+			return writeErr(c, v, id, e, debugf)
+		}
+		path = home.abs(path)
+		debugf("Opendir id=%d path=%s\n", id, path)
+		// A missing path or a file is reported here rather than by SSH_FXP_READDIR.
+		var a *Attr
+		a, e = fs.Stat(path, false)
+		if e == nil && a.Flags&ATTR_MODE != 0 && !a.Mode.IsDir() {
+			e = errNotDir
+		}
+		if e != nil {
+			return writeErr(c, v, id, e, debugf)
+		}
+		handle, e := h.newDir(path, int(opts.MaxOpenHandles), int(opts.MaxOpenDirs))
+		if e != nil {
+			return writeErr(c, v, id, e, debugf)
+		}
+		_, e = h.dirReader(fs, handle)
+		if e != nil {
+			_ = h.closeHandle(fs, handle)
+			return writeErr(c, v, id, e, debugf)
+		}
+		debugf("Opendir ret: handle=%s\n", handle)
+		return writeHandle(c, id, handle)
+	case ssh_FXP_READDIR:
+		var handle string
+		e = p.B32(&id).B32String(&handle).End()
+		if e != nil {
+			return writeErr(c, v, id, e, debugf)
+		}
+		debugf("Readdir id=%d handle=%s\n", id, handle)
+		if h.getDir(handle) == "" {
+			return writeErr(c, v, id, errInvalidHandle, debugf)
+		}
+		var fis []NamedAttr
+		var dr Dir
+		dr, e = h.dirReader(fs, handle)
+		if e == nil {
+			fis, e = dr.Readdir(1024)
+		}
+		debugf("Readdir ret: %v => %v\n", fis, e)
+		if e != nil {
+			return writeErr(c, v, id, e, debugf)
+		}
+		var l binp.Len
+		o := binp.Out().LenB32(&l).LenStart(&l).Byte(ssh_FXP_NAME).B32(id).B32(uint32(len(fis)))
+		for i := range fis {
+			outName(o, fis[i].Name, readdirLongName(&fis[i]), &fis[i].Attr, v)
+		}
+		o.LenDone(&l)
+		return wrc(c, o.Out())
+	case ssh_FXP_REMOVE:
+		var path string
+		e = p.B32(&id).B32String(&path).End()
+		if e != nil {
+			return writeErr(c, v, id, e, debugf)
+		}
+		path = home.abs(path)
+		debugf("Remove id=%d path=%s\n", id, path)
+		return writeErr(c, v, id, fs.Remove(path), debugf)
+	case ssh_FXP_MKDIR:
+		var path string
+		var a Attr
+		p = p.B32(&id).B32String(&path)
+		e = parseAttr(p, &a, v).End()
+		if e != nil {
+			return writeErr(c, v, id, e, debugf)
+		}
+		path = home.abs(path)
+		debugf("Mkdir id=%d path=%s\n", id, path)
+		return writeErr(c, v, id, fs.Mkdir(path, &a), debugf)
+	case ssh_FXP_RMDIR:
+		var path string
+		e = p.B32(&id).B32String(&path).End()
+		if e != nil {
+			return writeErr(c, v, id, e, debugf)
+		}
+		path = home.abs(path)
+		debugf("Rmdir id=%d path=%s\n", id, path)
+		return writeErr(c, v, id, fs.Rmdir(path), debugf)
+	case ssh_FXP_REALPATH:
+		var path, newpath string
+		var control byte = ssh_FXP_REALPATH_NO_CHECK
+		p = p.B32(&id).B32String(&path)
+		// SFTPv6 appends a control byte and paths to compose with the original.
+		if v >= 6 && p != nil && !p.AtEnd() {
+			p = p.B8(&control)
+			for p != nil && !p.AtEnd() {
+				var compose string
+				p = p.B32String(&compose)
+				path = composePath(path, compose)
 			}
-			var l binp.Len
-			o := binp.Out().LenB32(&l).LenStart(&l).Byte(ssh_FXP_NAME).B32(id).B32(uint32(len(fis)))
-			for _, fi := range fis {
-				n := fi.Name
-				o.B32String(n).B32String(readdirLongName(&fi)).B32(fi.Flags)
-				if fi.Flags&ATTR_SIZE != 0 {
-					o.B64(uint64(fi.Size))
-				}
-				if fi.Flags&ATTR_UIDGID != 0 {
-					o.B32(fi.Uid).B32(fi.Gid)
-				}
-				if fi.Flags&ATTR_MODE != 0 {
-					o.B32(fileModeToSftp(fi.Mode))
-				}
-				if fi.Flags&ATTR_TIME != 0 {
-					outTimes(o, &fi.Attr)
+		}
+		e = p.End()
+		if e != nil {
+			return writeErr(c, v, id, e, debugf)
+		}
+		path = home.abs(path)
+		debugf("RealPath id=%d path=%s control=%d\n", id, path, control)
+		newpath, e = fs.RealPath(path)
+		debugf("RealPath ret %s => %v\n", newpath, e)
+		a := &Attr{}
+		if e == nil && control != ssh_FXP_REALPATH_NO_CHECK {
+			var se error
+			a, se = fs.Stat(newpath, false)
+			if se != nil {
+				// STAT_IF answers with an unknown type instead.
+				if control == ssh_FXP_REALPATH_STAT_ALWAYS {
+					e = se
 				}
+				a = &Attr{}
 			}
-			o.LenDone(&l)
-			e = wrc(c, o.Out())
-		case ssh_FXP_REMOVE:
-			var path string
-			e = p.B32(&id).B32String(&path).End()
-			if e != nil {
-				return e
-			}
-			debugf("Remove id=%d path=%s\n", id, path)
-			e = writeErr(c, id, fs.Remove(path), debugf)
-		case ssh_FXP_MKDIR:
-			var path string
-			var a Attr
-			p = p.B32(&id).B32String(&path)
-			e = parseAttr(p, &a).End()
-			if e != nil {
-				return e
-			}
-			debugf("Mkdir id=%d path=%s\n", id, path)
-			e = writeErr(c, id, fs.Mkdir(path, &a), debugf)
-		case ssh_FXP_RMDIR:
-			var path string
-			e = p.B32(&id).B32String(&path).End()
-			if e != nil {
-				return e
-			}
-			debugf("Rmdir id=%d path=%s\n", id, path)
-			e = writeErr(c, id, fs.Rmdir(path), debugf)
-		case ssh_FXP_REALPATH:
-			var path, newpath string
-			e = p.B32(&id).B32String(&path).End()
-			if e != nil {
-				return e
-			}
-			debugf("RealPath id=%d path=%s\n", id, path)
-			newpath, e = fs.RealPath(path)
-			debugf("RealPath ret %s => %v\n", newpath, e)
-			e = writeNameOnly(c, id, newpath, e, debugf)
-		case ssh_FXP_RENAME:
-			var oldName, newName string
-			var flags uint32
-			e = p.B32(&id).B32String(&oldName).B32String(&newName).B32(&flags).End()
-			if e != nil {
-				return e
-			}
-			debugf("Rename id=%d oldName=%s newName=%s flags=%x\n", id, oldName, newName, flags)
-			e = writeErr(c, id, fs.Rename(oldName, newName, flags), debugf)
-		case ssh_FXP_READLINK:
-			var path string
-			e = p.B32(&id).B32String(&path).End()
-			if e != nil {
-				return e
-			}
-			debugf("ReadLink id=%d path=%s\n", id, path)
-			path, e = fs.ReadLink(path)
-			debugf("ReadLink ret %s\n", path)
-			e = writeNameOnly(c, id, path, e, debugf)
-		case ssh_FXP_SYMLINK:
-			e = writeErrCode(c, id, ssh_FX_OP_UNSUPPORTED, debugf)
 		}
+		return writeName(c, v, id, newpath, a, e, debugf)
+	case ssh_FXP_RENAME:
+		var oldName, newName string
+		var flags uint32
+		p = p.B32(&id).B32String(&oldName).B32String(&newName)
+		// SFTPv3 has no flags, later versions append them.
+		if p != nil && !p.AtEnd() {
+			p = p.B32(&flags)
+		}
+		e = p.End()
 		if e != nil {
-			debugf("Fatal error: %v\n", e)
-			return e
+			return writeErr(c, v, id, e, debugf)
 		}
+		oldName = home.abs(oldName)
+		newName = home.abs(newName)
+		debugf("Rename id=%d oldName=%s newName=%s flags=%x\n", id, oldName, newName, flags)
+		return writeErr(c, v, id, fs.Rename(oldName, newName, flags), debugf)
+	case ssh_FXP_READLINK:
+		var path string
+		e = p.B32(&id).B32String(&path).End()
+		if e != nil {
+			return writeErr(c, v, id, e, debugf)
+		}
+		path = home.abs(path)
+		debugf("ReadLink id=%d path=%s\n", id, path)
+		path, e = fs.ReadLink(path)
+		debugf("ReadLink ret %s\n", path)
+		return writeNameOnly(c, v, id, path, e, debugf)
+	case ssh_FXP_SYMLINK:
+		var linkPath, targetPath string
+		if opts.SymlinkSpecOrder {
+			e = p.B32(&id).B32String(&linkPath).B32String(&targetPath).End()
+		} else {
+			e = p.B32(&id).B32String(&targetPath).B32String(&linkPath).End()
+		}
+		if e != nil {
+			return writeErr(c, v, id, e, debugf)
+		}
+		linkPath = home.abs(linkPath)
+		debugf("Symlink id=%d linkPath=%s targetPath=%s\n", id, linkPath, targetPath)
+		return writeErr(c, v, id, fs.CreateLink(linkPath, targetPath, LINK_SYMBOLIC), debugf)
+	case ssh_FXP_LINK:
+		var linkPath, targetPath string
+		var symlink byte
+		e = p.B32(&id).B32String(&linkPath).B32String(&targetPath).B8(&symlink).End()
+		if e != nil {
+			return writeErr(c, v, id, e, debugf)
+		}
+		linkPath = home.abs(linkPath)
+		flags := uint32(LINK_SYMBOLIC)
+		if symlink == 0 {
+			targetPath = home.abs(targetPath)
+			flags = LINK_HARD
+		}
+		debugf("Link id=%d linkPath=%s targetPath=%s symlink=%d\n", id, linkPath, targetPath, symlink)
+		return writeErr(c, v, id, fs.CreateLink(linkPath, targetPath, flags), debugf)
+	case ssh_FXP_EXTENDED:
+		var name string
+		var data []byte
+		p = p.B32(&id).B32String(&name).PeekRest(&data)
+		e = p.Skip(len(data)).End()
+		if e != nil {
+			return writeErr(c, v, id, e, debugf)
+		}
+		debugf("Extended id=%d name=%s\n", id, name)
+		ext := opts.Extensions.lookup(name)
+		if ext == nil || (ext.supported != nil && !ext.supported(fs)) {
+			return writeErrCode(c, v, id, ssh_FX_OP_UNSUPPORTED, debugf)
+		}
+		r := &ExtendedRequest{Name: name, Data: data, FileSystem: fs, h: h, opts: opts, home: home, version: v}
+		var reply []byte
+		reply, e = ext.handler(r)
+		debugf("Extended ret: %X %v\n", reply, e)
+		return writeExtendedReply(c, v, id, r.replyType, reply, e, debugf)
 	}
+	p.B32(&id)
+	debugf("Unsupported op=%v id=%d\n", ssh_fxp(op), id)
+	return writeErrCode(c, v, id, ssh_FX_OP_UNSUPPORTED, debugf)
+}
+
+// channelWriter serializes the packets written by concurrently executed requests.
+// Every packet must be written with a single call to Write.
+type channelWriter struct {
+	mu sync.Mutex
+	w  io.Writer
 }
 
-var errInvalidHandle = errors.New("Client supplied an invalid handle")
-var errTooManyFiles = errors.New("Too many files")
+func (c *channelWriter) Write(bs []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.w.Write(bs)
+}
 
-const maxFiles = 0x100
+var errInvalidHandle = &StatusError{Code: STATUS_INVALID_HANDLE, Message: "Client supplied an invalid handle"}
+var errTooManyFiles = &StatusError{Code: STATUS_FAILURE, Message: "Too many files"}
+var errNotDir = &StatusError{Code: STATUS_NOT_A_DIRECTORY}
+var errWriteTooLong = &StatusError{Code: STATUS_FAILURE, Message: "Write exceeds the maximum write length"}
 
 func readPacketHeader(rd *bufio.Reader) (int, byte, error) {
 	bs := make([]byte, 5)
@@ -390,142 +854,102 @@ func readPacketHeader(rd *bufio.Reader) (int, byte, error) {
 	return int(binary.BigEndian.Uint32(bs)), bs[4], nil
 }
 
-func parseAttr(p *binp.Parser, a *Attr) *binp.Parser {
-	p = p.B32(&a.Flags)
-	if a.Flags&ssh_FILEXFER_ATTR_SIZE != 0 {
-		p = p.B64(&a.Size)
-	}
-	if a.Flags&ssh_FILEXFER_ATTR_UIDGID != 0 {
-		p = p.B32(&a.Uid).B32(&a.Gid)
-	}
-	if a.Flags&ssh_FILEXFER_ATTR_PERMISSIONS != 0 {
-		var mode uint32
-		p = p.B32(&mode)
-		a.Mode = sftpToFileMode(mode)
-	}
-	if a.Flags&ssh_FILEXFER_ATTR_ACMODTIME != 0 {
-		p = inTimes(p, a)
-	}
-	if a.Flags&ssh_FILEXFER_ATTR_EXTENDED != 0 {
-		var count uint32
-		p = p.B32(&count)
-		if count > 0xFF {
-			return nil
-		}
-		ss := make([]string, 2*int(count))
-		for i := 0; i < int(count); i++ {
-			var k, v string
-			p = p.B32String(&k).B32String(&v)
-			ss[2*i+0] = k
-			ss[2*i+1] = v
-		}
-		a.Extended = ss
+// skipAttrFlags skips the attribute flags later versions of the protocol append
+// to stat requests, all known attributes are returned anyway.
+func skipAttrFlags(p *binp.Parser, version uint32) *binp.Parser {
+	if version >= 4 && p != nil && !p.AtEnd() {
+		var flags uint32
+		p = p.B32(&flags)
 	}
 	return p
 }
 
-func writeAttr(c ssh.Channel, id uint32, a *Attr, e error, debugf DebugLogger) error {
-	if e != nil {
-		return writeErr(c, id, e, debugf)
-	}
-	var l binp.Len
-	o := binp.Out().LenB32(&l).LenStart(&l).Byte(ssh_FXP_ATTRS).B32(id).B32(a.Flags)
-	if a.Flags&ssh_FILEXFER_ATTR_SIZE != 0 {
-		o = o.B64(a.Size)
+// openFlagsV5 converts the desired access and flags of a SFTPv5+ open request to pflags.
+func openFlagsV5(access, flags uint32) uint32 {
+	var pflags uint32
+	if access&ace4_READ_DATA != 0 {
+		pflags |= ssh_FXF_READ
 	}
-	if a.Flags&ssh_FILEXFER_ATTR_UIDGID != 0 {
-		o = o.B32(a.Uid).B32(a.Gid)
+	if access&(ace4_WRITE_DATA|ace4_APPEND_DATA) != 0 {
+		pflags |= ssh_FXF_WRITE
 	}
-	if a.Flags&ssh_FILEXFER_ATTR_PERMISSIONS != 0 {
-		o = o.B32(fileModeToSftp(a.Mode))
+	if flags&(ssh_FXF_APPEND_DATA|ssh_FXF_APPEND_DATA_ATOMIC) != 0 {
+		pflags |= ssh_FXF_APPEND
 	}
-	if a.Flags&ssh_FILEXFER_ATTR_ACMODTIME != 0 {
-		outTimes(o, a)
+	switch flags & ssh_FXF_ACCESS_DISPOSITION {
+	case ssh_FXF_CREATE_NEW:
+		pflags |= ssh_FXF_CREAT | ssh_FXF_EXCL
+	case ssh_FXF_CREATE_TRUNCATE:
+		pflags |= ssh_FXF_CREAT | ssh_FXF_TRUNC
+	case ssh_FXF_OPEN_OR_CREATE:
+		pflags |= ssh_FXF_CREAT
+	case ssh_FXF_TRUNCATE_EXISTING:
+		pflags |= ssh_FXF_TRUNC
 	}
-	if a.Flags&ssh_FILEXFER_ATTR_EXTENDED != 0 {
-		count := uint32(len(a.Extended) / 2)
-		o = o.B32(count)
-		for _, s := range a.Extended {
-			o = o.B32String(s)
-		}
-	}
-	o.LenDone(&l)
-	return wrc(c, o.Out())
+	return pflags
+}
+
+func writeNameOnly(c io.Writer, version, id uint32, path string, e error, debugf DebugLogger) error {
+	return writeName(c, version, id, path, &Attr{}, e, debugf)
 }
 
-func writeNameOnly(c ssh.Channel, id uint32, path string, e error, debugf DebugLogger) error {
+// writeName sends a SSH_FXP_NAME packet with a single name.
+func writeName(c io.Writer, version, id uint32, path string, a *Attr, e error, debugf DebugLogger) error {
 	if e != nil {
-		return writeErr(c, id, e, debugf)
+		return writeErr(c, version, id, e, debugf)
 	}
 	var l binp.Len
 	o := binp.Out().LenB32(&l).LenStart(&l).Byte(ssh_FXP_NAME).B32(id).B32(1)
-	o.B32String(path).B32String(path).B32(0)
+	outName(o, path, path, a, version)
 	o.LenDone(&l)
 	return wrc(c, o.Out())
 }
 
-var failTmpl = []byte{0, 0, 0, 1 + 4 + 4 + 4 + 4, ssh_FXP_STATUS, 0, 0, 0, 0, 0, 0, 0, ssh_FX_FAILURE, 0, 0, 0, 0, 0, 0, 0, 0}
+func writeErrCode(c io.Writer, version, id uint32, code ssh_fx, debugf DebugLogger) error {
+	return writeStatus(c, version, id, StatusCode(code), StatusCode(code).String(), debugf)
+}
 
-func writeFail(c ssh.Channel, id uint32) error {
-	bs := make([]byte, len(failTmpl))
-	copy(bs, failTmpl)
-	binary.BigEndian.PutUint32(bs[5:], id)
-	return wrc(c, bs)
+// writeStatus sends a status with a message in English.
+func writeStatus(c io.Writer, version, id uint32, code StatusCode, msg string, debugf DebugLogger) error {
+	debugf("Sending sftp error code %v: %s\n", ssh_fx(code), msg)
+	code = compatStatus(code, version)
+	var l binp.Len
+	o := binp.OutCap(4 + 1 + 4 + 4 + 4 + len(msg) + 4 + 2).LenB32(&l).LenStart(&l).Byte(ssh_FXP_STATUS).B32(id).B32(uint32(code))
+	o.B32String(msg).B32String("en").LenDone(&l)
+	return wrc(c, o.Out())
 }
 
-func writeErrCode(c ssh.Channel, id uint32, code ssh_fx, debugf DebugLogger) error {
-	bs := make([]byte, len(failTmpl))
-	copy(bs, failTmpl)
-	binary.BigEndian.PutUint32(bs[5:], id)
-	debugf("Sending sftp error code %v\n", code)
-	bs[12] = byte(code)
-	return wrc(c, bs)
+func writeErr(c io.Writer, version, id uint32, err error, debugf DebugLogger) error {
+	code, msg := errorStatus(err)
+	return writeStatus(c, version, id, code, msg, debugf)
 }
 
-func writeErr(c ssh.Channel, id uint32, err error, debugf DebugLogger) error {
-	var code ssh_fx
-	switch {
-	case err == nil:
-		code = ssh_FX_OK
-	case err == io.EOF:
-		code = ssh_FX_EOF
-	case os.IsPermission(err):
-		code = ssh_FX_PERMISSION_DENIED
-	case os.IsNotExist(err):
-		code = ssh_FX_NO_SUCH_FILE
-	default:
-		code = ssh_FX_FAILURE
+func writeExtendedReply(c io.Writer, version, id uint32, typ byte, reply []byte, e error, debugf DebugLogger) error {
+	if e != nil || reply == nil {
+		return writeErr(c, version, id, e, debugf)
 	}
-	return writeErrCode(c, id, code, debugf)
+	if typ == 0 {
+		typ = ssh_FXP_EXTENDED_REPLY
+	}
+	return wrc(c, binp.OutCap(4+5+len(reply)).B32(uint32(5+len(reply))).B8(typ).B32(id).Bytes(reply).Out())
 }
 
-func writeHandle(c ssh.Channel, id uint32, handle string) error {
-	return wrc(c, binp.OutCap(4+9+len(handle)).B32(uint32(9+len(handle))).B8(ssh_FXP_HANDLE).B32(id).B32String(handle).Out())
+// versionReply builds the SSH_FXP_VERSION packet advertising the extensions usable with fs.
+func versionReply(version uint32, fs FileSystem, exts *Extensions) []byte {
+	var l binp.Len
+	o := binp.Out().LenB32(&l).LenStart(&l).Byte(ssh_FXP_VERSION).B32(version)
+	for _, ext := range exts.advertised(fs) {
+		o.B32String(ext.name).B32String(ext.data)
+	}
+	o.LenDone(&l)
+	return o.Out()
 }
 
-func wrc(c ssh.Channel, bs []byte) error {
-	_, e := c.Write(bs)
-	return e
+func writeHandle(c io.Writer, id uint32, handle string) error {
+	return wrc(c, binp.OutCap(4+9+len(handle)).B32(uint32(9+len(handle))).B8(ssh_FXP_HANDLE).B32(id).B32String(handle).Out())
 }
 
-func discard(brd *bufio.Reader, n int) error {
-	if n == 0 {
-		return nil
-	}
-	m, e := io.Copy(io.Discard, &io.LimitedReader{R: brd, N: int64(n)})
-	if int(m) == n && e == io.EOF {
-		e = nil
-	}
+func wrc(c io.Writer, bs []byte) error {
+	_, e := c.Write(bs)
 	return e
 }
-
-func outTimes(o *binp.Printer, a *Attr) {
-	o.B32(uint32(a.ATime.Unix())).B32(uint32(a.MTime.Unix()))
-}
-func inTimes(p *binp.Parser, a *Attr) *binp.Parser {
-	var at, mt uint32
-	p = p.B32(&at).B32(&mt)
-	a.ATime = time.Unix(int64(at), 0)
-	a.MTime = time.Unix(int64(mt), 0)
-	return p
-}
@@ -0,0 +1,55 @@
+package sftpd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/OpenListTeam/sftpd-openlist/binp"
+)
+
+func TestWithDefaultsWriteLength(t *testing.T) {
+	tests := []struct {
+		packet, write, want uint32
+	}{
+		{0, 0, defaultMaxPacketLength - writeHeaderRoom},
+		{0, 1024 * 1024, defaultMaxPacketLength - writeHeaderRoom},
+		{0, 4096, 4096},
+		{1024, 0, minPacketLength - writeHeaderRoom},
+		{256 * 1024, 128 * 1024, 128 * 1024},
+	}
+	for _, tt := range tests {
+		o := (&ServeOptions{MaxPacketLength: tt.packet, MaxWriteLength: tt.write}).withDefaults()
+		if o.MaxWriteLength != tt.want {
+			t.Errorf("packet %d write %d: MaxWriteLength = %d, want %d", tt.packet, tt.write, o.MaxWriteLength, tt.want)
+		}
+	}
+}
+
+func TestStalledHandleDoesNotBlockOtherRequests(t *testing.T) {
+	fs := newMemFS(map[string]string{"/slow": "slow data", "/other": "other data"})
+	fs.stall, fs.stalled = make(chan struct{}), "/slow"
+	c := newTestClient(t, fs, &ServeOptions{MaxConcurrentRequests: 4}, 3)
+	defer c.close()
+	h := c.open(1, "/slow", ssh_FXF_READ)
+	// Writes to the pipe block while the server does not read requests.
+	go func() {
+		for id := uint32(2); id < 10; id++ {
+			c.send(ssh_FXP_READ, binp.Out().B32(id).B32String(h).B64(0).B32(1024))
+		}
+		c.send(ssh_FXP_STAT, binp.Out().B32(10).B32String("/other"))
+	}()
+	op, data, ok := c.recvTimeout(2 * time.Second)
+	var id uint32
+	if !ok {
+		t.Error("STAT not answered while the reads of another handle are stalled")
+	} else if binp.NewParser(data).B32(&id); op != ssh_FXP_ATTRS || id != 10 {
+		t.Errorf("got packet type %d for id %d, want the attributes of STAT", op, id)
+	}
+	close(fs.stall)
+	for n := 0; n < 8; n++ {
+		c.recv()
+	}
+	if !ok {
+		c.recv()
+	}
+}
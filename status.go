@@ -0,0 +1,181 @@
+package sftpd
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+
+	"github.com/OpenListTeam/sftpd-openlist/binp"
+)
+
+// StatusCode is the code of a SSH_FXP_STATUS reply.
+type StatusCode uint32
+
+// Status codes, the ones after STATUS_OP_UNSUPPORTED were added by later versions
+// of the protocol and are sent to older clients as the closest older code.
+const (
+	STATUS_OK                          StatusCode = ssh_FX_OK
+	STATUS_EOF                         StatusCode = ssh_FX_EOF
+	STATUS_NO_SUCH_FILE                StatusCode = ssh_FX_NO_SUCH_FILE
+	STATUS_PERMISSION_DENIED           StatusCode = ssh_FX_PERMISSION_DENIED
+	STATUS_FAILURE                     StatusCode = ssh_FX_FAILURE
+	STATUS_BAD_MESSAGE                 StatusCode = ssh_FX_BAD_MESSAGE
+	STATUS_NO_CONNECTION               StatusCode = ssh_FX_NO_CONNECTION
+	STATUS_CONNECTION_LOST             StatusCode = ssh_FX_CONNECTION_LOST
+	STATUS_OP_UNSUPPORTED              StatusCode = ssh_FX_OP_UNSUPPORTED
+	STATUS_INVALID_HANDLE              StatusCode = ssh_FX_INVALID_HANDLE
+	STATUS_NO_SUCH_PATH                StatusCode = ssh_FX_NO_SUCH_PATH
+	STATUS_FILE_ALREADY_EXISTS         StatusCode = ssh_FX_FILE_ALREADY_EXISTS
+	STATUS_WRITE_PROTECT               StatusCode = ssh_FX_WRITE_PROTECT
+	STATUS_NO_MEDIA                    StatusCode = ssh_FX_NO_MEDIA
+	STATUS_NO_SPACE_ON_FILESYSTEM      StatusCode = ssh_FX_NO_SPACE_ON_FILESYSTEM
+	STATUS_QUOTA_EXCEEDED              StatusCode = ssh_FX_QUOTA_EXCEEDED
+	STATUS_UNKNOWN_PRINCIPAL           StatusCode = ssh_FX_UNKNOWN_PRINCIPAL
+	STATUS_LOCK_CONFLICT               StatusCode = ssh_FX_LOCK_CONFLICT
+	STATUS_DIR_NOT_EMPTY               StatusCode = ssh_FX_DIR_NOT_EMPTY
+	STATUS_NOT_A_DIRECTORY             StatusCode = ssh_FX_NOT_A_DIRECTORY
+	STATUS_INVALID_FILENAME            StatusCode = ssh_FX_INVALID_FILENAME
+	STATUS_LINK_LOOP                   StatusCode = ssh_FX_LINK_LOOP
+	STATUS_CANNOT_DELETE               StatusCode = ssh_FX_CANNOT_DELETE
+	STATUS_INVALID_PARAMETER           StatusCode = ssh_FX_INVALID_PARAMETER
+	STATUS_FILE_IS_A_DIRECTORY         StatusCode = ssh_FX_FILE_IS_A_DIRECTORY
+	STATUS_BYTE_RANGE_LOCK_CONFLICT    StatusCode = ssh_FX_BYTE_RANGE_LOCK_CONFLICT
+	STATUS_BYTE_RANGE_LOCK_REFUSED     StatusCode = ssh_FX_BYTE_RANGE_LOCK_REFUSED
+	STATUS_DELETE_PENDING              StatusCode = ssh_FX_DELETE_PENDING
+	STATUS_FILE_CORRUPT                StatusCode = ssh_FX_FILE_CORRUPT
+	STATUS_OWNER_INVALID               StatusCode = ssh_FX_OWNER_INVALID
+	STATUS_GROUP_INVALID               StatusCode = ssh_FX_GROUP_INVALID
+	STATUS_NO_MATCHING_BYTE_RANGE_LOCK StatusCode = ssh_FX_NO_MATCHING_BYTE_RANGE_LOCK
+)
+
+// String returns the default message sent with the code.
+func (c StatusCode) String() string {
+	if s := statusText[c]; s != "" {
+		return s
+	}
+	return "Failure"
+}
+
+var statusText = map[StatusCode]string{
+	STATUS_OK:                          "Success",
+	STATUS_EOF:                         "End of file",
+	STATUS_NO_SUCH_FILE:                "No such file",
+	STATUS_PERMISSION_DENIED:           "Permission denied",
+	STATUS_FAILURE:                     "Failure",
+	STATUS_BAD_MESSAGE:                 "Bad message",
+	STATUS_NO_CONNECTION:               "No connection",
+	STATUS_CONNECTION_LOST:             "Connection lost",
+	STATUS_OP_UNSUPPORTED:              "Operation unsupported",
+	STATUS_INVALID_HANDLE:              "Invalid handle",
+	STATUS_NO_SUCH_PATH:                "No such path",
+	STATUS_FILE_ALREADY_EXISTS:         "File already exists",
+	STATUS_WRITE_PROTECT:               "Write protected",
+	STATUS_NO_MEDIA:                    "No media",
+	STATUS_NO_SPACE_ON_FILESYSTEM:      "No space left on filesystem",
+	STATUS_QUOTA_EXCEEDED:              "Quota exceeded",
+	STATUS_UNKNOWN_PRINCIPAL:           "Unknown principal",
+	STATUS_LOCK_CONFLICT:               "Lock conflict",
+	STATUS_DIR_NOT_EMPTY:               "Directory not empty",
+	STATUS_NOT_A_DIRECTORY:             "Not a directory",
+	STATUS_INVALID_FILENAME:            "Invalid filename",
+	STATUS_LINK_LOOP:                   "Too many symbolic links",
+	STATUS_CANNOT_DELETE:               "Cannot delete",
+	STATUS_INVALID_PARAMETER:           "Invalid parameter",
+	STATUS_FILE_IS_A_DIRECTORY:         "File is a directory",
+	STATUS_BYTE_RANGE_LOCK_CONFLICT:    "Byte range lock conflict",
+	STATUS_BYTE_RANGE_LOCK_REFUSED:     "Byte range lock refused",
+	STATUS_DELETE_PENDING:              "Delete pending",
+	STATUS_FILE_CORRUPT:                "File corrupt",
+	STATUS_OWNER_INVALID:               "Invalid owner",
+	STATUS_GROUP_INVALID:               "Invalid group",
+	STATUS_NO_MATCHING_BYTE_RANGE_LOCK: "No matching byte range lock",
+}
+
+// StatusError is an error a FileSystem can return to choose the status code and
+// message the client receives. Other errors are mapped to a status automatically
+// and sent with its default message.
+type StatusError struct {
+	Code StatusCode
+	// Message is sent to the client, the default message of Code if empty.
+	Message string
+	// Err is the underlying error, if any.
+	Err error
+}
+
+func (e *StatusError) Error() string {
+	msg := e.Message
+	if msg == "" {
+		msg = e.Code.String()
+	}
+	if e.Err != nil {
+		return msg + ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *StatusError) Unwrap() error { return e.Err }
+
+// errorStatusMapping maps an error to a status code and fixed message.
+type errorStatusMapping struct {
+	err  error
+	code StatusCode
+	msg  string
+}
+
+// errorStatuses are the errors mapped to a status code and fixed message,
+// they are checked in order with errors.Is. The errnos of the platform come
+// first as e.g. ENOTEMPTY also matches fs.ErrExist.
+var errorStatuses = append(append([]errorStatusMapping{
+	{io.EOF, STATUS_EOF, ""},
+	{binp.ErrInvalidInput, STATUS_BAD_MESSAGE, ""},
+	{errors.ErrUnsupported, STATUS_OP_UNSUPPORTED, ""},
+}, errnoStatuses...), []errorStatusMapping{
+	{fs.ErrPermission, STATUS_PERMISSION_DENIED, ""},
+	{fs.ErrNotExist, STATUS_NO_SUCH_FILE, ""},
+	{fs.ErrExist, STATUS_FILE_ALREADY_EXISTS, ""},
+	{context.DeadlineExceeded, STATUS_FAILURE, "Operation timed out"},
+	{os.ErrDeadlineExceeded, STATUS_FAILURE, "Operation timed out"},
+	{context.Canceled, STATUS_FAILURE, "Operation canceled"},
+}...)
+
+// errorStatus returns the status code and message reported to the client for err.
+func errorStatus(err error) (StatusCode, string) {
+	if err == nil {
+		return STATUS_OK, STATUS_OK.String()
+	}
+	var se *StatusError
+	if errors.As(err, &se) {
+		if se.Message != "" {
+			return se.Code, se.Message
+		}
+		return se.Code, se.Code.String()
+	}
+	for _, s := range errorStatuses {
+		if errors.Is(err, s.err) {
+			if s.msg != "" {
+				return s.code, s.msg
+			}
+			return s.code, s.code.String()
+		}
+	}
+	// The text of other errors may reveal details of the FileSystem, like the
+	// URLs of a HTTP storage, a StatusError chooses the message instead.
+	return STATUS_FAILURE, STATUS_FAILURE.String()
+}
+
+// compatStatus returns the code sent for c to clients of the protocol version.
+func compatStatus(c StatusCode, version uint32) StatusCode {
+	switch {
+	case c <= STATUS_OP_UNSUPPORTED, version >= 6,
+		version == 5 && c <= STATUS_LOCK_CONFLICT,
+		version == 4 && c <= STATUS_NO_MEDIA:
+		return c
+	case c == STATUS_NO_SUCH_PATH:
+		return STATUS_NO_SUCH_FILE
+	case c == STATUS_WRITE_PROTECT:
+		return STATUS_PERMISSION_DENIED
+	}
+	return STATUS_FAILURE
+}
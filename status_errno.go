@@ -0,0 +1,17 @@
+//go:build !plan9
+
+package sftpd
+
+import "syscall"
+
+// errnoStatuses are the errnos mapped to a status code.
+var errnoStatuses = []errorStatusMapping{
+	{syscall.ENOSPC, STATUS_NO_SPACE_ON_FILESYSTEM, ""},
+	{syscall.EDQUOT, STATUS_QUOTA_EXCEEDED, ""},
+	{syscall.ENOTEMPTY, STATUS_DIR_NOT_EMPTY, ""},
+	{syscall.ENOTDIR, STATUS_NOT_A_DIRECTORY, ""},
+	{syscall.EISDIR, STATUS_FILE_IS_A_DIRECTORY, ""},
+	{syscall.ELOOP, STATUS_LINK_LOOP, ""},
+	{syscall.EROFS, STATUS_WRITE_PROTECT, ""},
+	{syscall.ENAMETOOLONG, STATUS_INVALID_FILENAME, "File name too long"},
+}
@@ -0,0 +1,4 @@
+package sftpd
+
+// errnoStatuses is empty, Plan 9 reports errors as strings without errnos.
+var errnoStatuses []errorStatusMapping
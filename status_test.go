@@ -0,0 +1,31 @@
+package sftpd
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"testing"
+)
+
+func TestErrorStatusMessages(t *testing.T) {
+	secret := errors.New(`Get "https://storage.internal/f?signature=secret": connection refused`)
+	tests := []struct {
+		err  error
+		code StatusCode
+		msg  string
+	}{
+		{nil, STATUS_OK, "Success"},
+		{secret, STATUS_FAILURE, "Failure"},
+		{&fs.PathError{Op: "open", Path: "/f", Err: secret}, STATUS_FAILURE, "Failure"},
+		{&fs.PathError{Op: "open", Path: "/f", Err: os.ErrNotExist}, STATUS_NO_SUCH_FILE, "No such file"},
+		{&StatusError{Code: STATUS_FAILURE, Message: "Chosen message", Err: secret}, STATUS_FAILURE, "Chosen message"},
+		{&StatusError{Code: STATUS_PERMISSION_DENIED, Err: secret}, STATUS_PERMISSION_DENIED, "Permission denied"},
+		{errors.Join(errSpillFull, secret), STATUS_FAILURE, errSpillFull.Message},
+	}
+	for _, tt := range tests {
+		code, msg := errorStatus(tt.err)
+		if code != tt.code || msg != tt.msg {
+			t.Errorf("errorStatus(%v) = %v %q, want %v %q", tt.err, code, msg, tt.code, tt.msg)
+		}
+	}
+}